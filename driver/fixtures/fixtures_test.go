@@ -1,14 +1,22 @@
 package fixtures
 
 import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/bblfsh/csharp-driver/driver/impl"
 	"github.com/bblfsh/csharp-driver/driver/normalizer"
 	"github.com/bblfsh/sdk/v3/driver"
 	"github.com/bblfsh/sdk/v3/driver/fixtures"
-	"github.com/bblfsh/sdk/v3/driver/native"
+	"github.com/bblfsh/sdk/v3/driver/manifest"
+	"github.com/bblfsh/sdk/v3/protocol"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
 	"github.com/bblfsh/sdk/v3/uast/transformer/positioner"
+	"google.golang.org/grpc"
 )
 
 const projectRoot = "../../"
@@ -18,26 +26,48 @@ var Suite = &fixtures.Suite{
 	Ext:  ".cs",
 	Path: filepath.Join(projectRoot, fixtures.Dir),
 	NewDriver: func() driver.Native {
-		return native.NewDriverAt(filepath.Join(projectRoot, "build/bin/native"), native.UTF8)
+		d := impl.NewDriverAt(filepath.Join(projectRoot, "build/bin/native"))
+		// fixtures are stored in the full schema
+		d.Schema = impl.SchemaFull
+		return d
 	},
 	Transforms: normalizer.Transforms,
 	BenchName:  "parser_context",
 	Semantic: fixtures.SemanticConfig{
 		BlacklistTypes: []string{
+			"AccessorList",
+			"AddAccessorDeclaration",
+			"AnonymousMethodExpression",
 			"ArgListKeyword",
 			"Block",
+			"ClassDeclaration",
 			"ConstructorDeclaration",
+			"ConversionOperatorDeclaration",
 			"DestructorDeclaration",
+			"EnumDeclaration",
+			"EventDeclaration",
 			"FalseLiteralExpression",
+			"GetAccessorDeclaration",
 			"IdentifierName",
 			"IdentifierToken",
+			"IndexerDeclaration",
+			"InterfaceDeclaration",
+			"LocalFunctionStatement",
 			"MethodDeclaration",
 			"MultiLineCommentTrivia",
+			"MultiLineDocumentationCommentTrivia",
+			"OperatorDeclaration",
 			"Parameter",
+			"ParenthesizedLambdaExpression",
+			"PropertyDeclaration",
 			"QualifiedName",
+			"RemoveAccessorDeclaration",
+			"SetAccessorDeclaration",
+			"SimpleLambdaExpression",
 			"SingleLineCommentTrivia",
 			"SingleLineDocumentationCommentTrivia",
 			"StringLiteralExpression",
+			"StructDeclaration",
 			"TrueLiteralExpression",
 			"UsingDirective",
 		},
@@ -48,6 +78,7 @@ var Suite = &fixtures.Suite{
 			"ClassKeyword",
 			"FalseLiteralExpression",
 			"MultiLineCommentTrivia",
+			"MultiLineDocumentationCommentTrivia",
 			"QualifiedName",
 			"SingleLineCommentTrivia",
 			"SingleLineDocumentationCommentTrivia",
@@ -62,6 +93,83 @@ func TestCsharpDriver(t *testing.T) {
 	Suite.RunTests(t)
 }
 
+// TestSyntaxErrorServer checks that files with syntax errors are parsed successfully when
+// requested through the gRPC server, and that erroneous nodes are marked in the semantic UAST.
+func TestSyntaxErrorServer(t *testing.T) {
+	if _, err := os.Stat(filepath.Join(projectRoot, "build/bin/native")); err != nil {
+		t.Skip("native parser is not built")
+	}
+	src, err := ioutil.ReadFile(filepath.Join(Suite.Path, "recovery.cs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drv, err := driver.NewDriverFrom(Suite.NewDriver(), &manifest.Manifest{Language: "csharp"}, Suite.Transforms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = drv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer drv.Close()
+
+	srv := grpc.NewServer(protocol.ServerOptions()...)
+	protocol.RegisterDriver(srv, drv)
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial(lis.Addr().String(), append([]grpc.DialOption{grpc.WithInsecure()}, protocol.DialOptions()...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	ast, err := protocol.AsDriver(cc).Parse(context.Background(), string(src), &driver.ParseOptions{
+		Mode: driver.ModeSemantic, Language: "csharp",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := ast.(nodes.Object)
+	if diags, _ := root["Diagnostics"].(nodes.Array); len(diags) == 0 {
+		t.Fatal("expected diagnostics in the root node")
+	}
+	erroneous := 0
+	nodes.WalkPreOrder(ast, func(n nodes.Node) bool {
+		if obj, ok := n.(nodes.Object); ok && obj["Erroneous"] == nodes.Bool(true) {
+			erroneous++
+		}
+		return true
+	})
+	if erroneous == 0 {
+		t.Fatal("expected erroneous nodes in the semantic UAST")
+	}
+}
+
 func BenchmarkCsharpDriver(b *testing.B) {
 	Suite.RunBenchmarks(b)
+
+	// same benchmarks with a compact wire format of the native parser
+	msgpack := *Suite
+	msgpack.NewDriver = func() driver.Native {
+		d := impl.NewDriverAt(filepath.Join(projectRoot, "build/bin/native"))
+		d.Format = impl.WireMsgpack
+		d.Schema = impl.SchemaFull
+		return d
+	}
+	b.Run("msgpack", msgpack.RunBenchmarks)
+
+	// and with the lean schema of native ASTs
+	lean := *Suite
+	lean.NewDriver = func() driver.Native {
+		d := impl.NewDriverAt(filepath.Join(projectRoot, "build/bin/native"))
+		d.Format = impl.WireMsgpack
+		d.Schema = impl.SchemaLean
+		return d
+	}
+	b.Run("lean", lean.RunBenchmarks)
 }
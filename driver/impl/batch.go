@@ -0,0 +1,236 @@
+package impl
+
+import (
+	"context"
+
+	"github.com/bblfsh/sdk/v3/driver"
+	"github.com/bblfsh/sdk/v3/driver/native"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+)
+
+// batchSize is the maximal number of files sent to the native parser in a single request.
+// Larger batches are split into multiple requests, and Pool distributes them between parsers.
+const batchSize = 64
+
+// File is a source file in a batch request.
+type File struct {
+	Path    string
+	Content string
+}
+
+// FileResult is a result of parsing a single file from a batch request.
+type FileResult struct {
+	Path string
+	// AST is the native AST of the file. Syntax errors are reported in the AST (see Diagnostic).
+	AST nodes.Node
+	// Err is an error returned by the parser, the same as for Driver.Parse.
+	Err error
+
+	size int // size of the native AST as received from the parser; zero if unknown
+}
+
+// batchFile is a file in a batch request to the native parser.
+type batchFile struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+// ParseBatch parses multiple files with a minimal number of requests to the native parser.
+// It saves the per-request overhead when parsing a lot of small files.
+//
+// Results are sent to the returned channel as soon as they are received from the native parser,
+// in the same order as files. The channel is closed after the last result. Errors are reported
+// for each file separately.
+//
+// Parse options are taken from the context, the same way as for Parse. The timeout and the size
+// limit apply to each file separately. If multiple symbol sets are specified, files are parsed
+// one by one.
+//
+// The caller must either read all results, or cancel the context. If the context is canceled,
+// the rest of the results is discarded and the native parser is restarted.
+func (d *Driver) ParseBatch(ctx context.Context, files []File) <-chan FileResult {
+	out := make(chan FileResult)
+	go func() {
+		defer close(out)
+		d.parseBatch(ctx, files, out)
+	}()
+	return out
+}
+
+func (d *Driver) parseBatch(ctx context.Context, files []File, out chan<- FileResult) {
+	opts := parseOptionsFrom(ctx)
+	if sets := opts.symbolSets(); len(sets) > 1 {
+		// parse results with different symbol sets must be merged (see Parse)
+		for _, f := range files {
+			ast, err := d.Parse(ctx, f.Content)
+			if !send(ctx, FileResult{Path: f.Path, AST: ast, Err: err}, out) {
+				return
+			}
+		}
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.started {
+		sendErr(ctx, files, driver.ErrDriverFailure.Wrap(native.ErrNotRunning.New()), out)
+		return
+	}
+	for len(files) != 0 {
+		n := len(files)
+		if n > batchSize {
+			n = batchSize
+		}
+		if !d.parseChunk(ctx, opts, files[:n], out) {
+			return
+		}
+		files = files[n:]
+	}
+}
+
+// parseChunk sends a single batch request to the native parser and reads a response for
+// each file. It returns false if the context was canceled. It must be called with the mutex held.
+func (d *Driver) parseChunk(ctx context.Context, opts ParseOptions, files []File, out chan<- FileResult) bool {
+	// the timeout applies to each file separately
+	fileCtx := func() (context.Context, func()) {
+		if opts.Timeout > 0 {
+			return context.WithTimeout(ctx, opts.Timeout)
+		}
+		return ctx, func() {}
+	}
+	req := &parseRequest{
+		Symbols: opts.symbolSets()[0], LanguageVersion: opts.LanguageVersion,
+		Files: make([]batchFile, 0, len(files)), MaxSize: opts.MaxSize,
+	}
+	for _, f := range files {
+		req.Files = append(req.Files, batchFile{Path: f.Path, Content: f.Content})
+	}
+	if err := d.revive(); err != nil {
+		return sendErr(ctx, files, err, out)
+	}
+	defer d.resetDeadline()
+
+	fctx, cancel := fileCtx()
+	d.setDeadline(fctx)
+	err := d.send(fctx, req)
+	cancel()
+	if err != nil {
+		return sendErr(ctx, files, err, out)
+	}
+	gen := d.gen
+	for i, f := range files {
+		fctx, cancel := fileCtx()
+		d.setDeadline(fctx)
+		ast, vers, err := d.receive(fctx, opts.MaxSize)
+		cancel()
+		res := FileResult{Path: f.Path, AST: withLanguageVersion(ast, opts, vers), Err: err, size: d.lines.last}
+		if d.broken || d.gen != gen {
+			// the parser was stopped or has crashed, the rest of the files won't be parsed
+			return send(ctx, res, out) && sendErr(ctx, files[i+1:], err, out)
+		}
+		if !send(ctx, res, out) {
+			// responses for the rest of the files are still in the pipe
+			d.kill()
+			return false
+		}
+	}
+	return true
+}
+
+// send sends the result to the channel. It returns false if the context was canceled.
+func send(ctx context.Context, res FileResult, out chan<- FileResult) bool {
+	if ctx.Err() != nil {
+		// don't send results after the cancellation, even if the reader is ready
+		return false
+	}
+	select {
+	case out <- res:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sendErr sends the same error for each file. It returns false if the context was canceled.
+func sendErr(ctx context.Context, files []File, err error, out chan<- FileResult) bool {
+	for _, f := range files {
+		if !send(ctx, FileResult{Path: f.Path, Err: err}, out) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseBatch parses multiple files the same way as Driver.ParseBatch, but distributes them
+// between native parsers in the pool. Results are still sent in the same order as files.
+func (p *Pool) ParseBatch(ctx context.Context, files []File) <-chan FileResult {
+	out := make(chan FileResult)
+	// results of each chunk of files, in the same order as chunks;
+	// the capacity limits the number of chunks parsed concurrently
+	chunks := make(chan chan FileResult, p.size)
+	go func() {
+		defer close(chunks)
+		for len(files) != 0 {
+			n := len(files)
+			if n > batchSize {
+				n = batchSize
+			}
+			chunk := files[:n]
+			files = files[n:]
+
+			// buffered, so parsers are not blocked by the previous chunks
+			res := make(chan FileResult, len(chunk))
+			select {
+			case chunks <- res:
+			case <-ctx.Done():
+				return
+			}
+			go func() {
+				defer close(res)
+				w, err := p.acquire()
+				if err != nil {
+					sendErr(ctx, chunk, err, res)
+					return
+				}
+				defer p.release(w)
+				for r := range w.ParseBatch(ctx, chunk) {
+					res <- r
+				}
+			}()
+		}
+	}()
+	go func() {
+		defer close(out)
+		for res := range chunks {
+			for r := range res {
+				if !send(ctx, r, out) {
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// batchParser is a native driver that can parse multiple files with a single request.
+type batchParser interface {
+	ParseBatch(ctx context.Context, files []File) <-chan FileResult
+}
+
+// parseBatch parses files with the native driver. If the driver doesn't support batch requests,
+// files are parsed one by one. Results are sent in the same order as files.
+func parseBatch(ctx context.Context, d driver.Native, files []File) <-chan FileResult {
+	if b, ok := d.(batchParser); ok {
+		return b.ParseBatch(ctx, files)
+	}
+	out := make(chan FileResult)
+	go func() {
+		defer close(out)
+		for _, f := range files {
+			ast, err := d.Parse(ctx, f.Content)
+			if !send(ctx, FileResult{Path: f.Path, AST: ast, Err: err}, out) {
+				return
+			}
+		}
+	}()
+	return out
+}
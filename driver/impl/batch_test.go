@@ -0,0 +1,170 @@
+package impl
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bblfsh/sdk/v3/driver"
+	"github.com/bblfsh/sdk/v3/driver/native"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+)
+
+// collectResults reads all results of the batch request, failing if the channel is not closed in time.
+func collectResults(t testing.TB, ch <-chan FileResult) []FileResult {
+	var out []FileResult
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case r, ok := <-ch:
+			if !ok {
+				return out
+			}
+			out = append(out, r)
+		case <-timeout:
+			t.Fatal("the batch request is not finished")
+		}
+	}
+}
+
+// checkContent checks that the result is the AST of a given "file..." content (see fakeParser).
+func checkContent(t testing.TB, r FileResult, content string) {
+	if r.Err != nil {
+		t.Fatalf("%s: %v", r.Path, r.Err)
+	}
+	obj, _ := r.AST.(nodes.Object)
+	if obj["content"] != nodes.String(content) {
+		t.Fatalf("%s: unexpected AST: %v", r.Path, r.AST)
+	}
+}
+
+func TestParseBatchOrder(t *testing.T) {
+	p, closer := newFakePool(t, 2)
+	defer closer()
+
+	// the first chunk is the slowest, but its results must be sent first
+	files := make([]File, 0, 2*batchSize+10)
+	for i := 0; i < cap(files); i++ {
+		content := fmt.Sprintf("file%d", i)
+		if i == 1 {
+			content = "delay"
+		}
+		files = append(files, File{Path: fmt.Sprintf("%d.cs", i), Content: content})
+	}
+	res := collectResults(t, p.ParseBatch(context.Background(), files))
+	if len(res) != len(files) {
+		t.Fatalf("expected %d results, got %d", len(files), len(res))
+	}
+	for i, r := range res {
+		if r.Path != files[i].Path {
+			t.Fatalf("unexpected order: %q at %d", r.Path, i)
+		}
+		if i != 1 {
+			checkContent(t, r, files[i].Content)
+		} else if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+	}
+}
+
+func TestParseBatchErrors(t *testing.T) {
+	d, closer := newFakeDriver(t)
+	defer closer()
+	ctx := context.Background()
+
+	res := collectResults(t, d.ParseBatch(ctx, []File{
+		{Path: "a.cs", Content: "file1"},
+		{Path: "b.cs", Content: "huge"},
+		{Path: "c.cs", Content: "file2"},
+	}))
+	if len(res) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(res))
+	}
+	checkContent(t, res[0], "file1")
+	if err := res[1].Err; !ErrTooLarge.Is(err) {
+		t.Fatalf("expected the AST to be too large, got: %v", err)
+	}
+	checkContent(t, res[2], "file2")
+
+	// the rest of the files fail if the parser crashes
+	res = collectResults(t, d.ParseBatch(ctx, []File{
+		{Path: "a.cs", Content: "file1"},
+		{Path: "b.cs", Content: "crash"},
+		{Path: "c.cs", Content: "file2"},
+	}))
+	if len(res) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(res))
+	}
+	checkContent(t, res[0], "file1")
+	for _, r := range res[1:] {
+		if !native.ErrDriverCrashed.Is(r.Err) {
+			t.Fatalf("%s: expected a crash, got: %v", r.Path, r.Err)
+		}
+	}
+	if _, err := d.Parse(ctx, "ok"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseBatchCancel(t *testing.T) {
+	d, closer := newFakeDriver(t)
+	defer closer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	files := make([]File, 5)
+	for i := range files {
+		files[i] = File{Path: fmt.Sprintf("%d.cs", i), Content: "delay"}
+	}
+	ch := d.ParseBatch(ctx, files)
+	if r := <-ch; r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	cancel()
+	// the rest of the results are discarded
+	start := time.Now()
+	collectResults(t, ch)
+	if dt := time.Since(start); dt > time.Second {
+		t.Fatalf("the batch request was not canceled in time: %v", dt)
+	}
+	// the parser is restarted, since it's still sending responses
+	gen := d.gen
+	if _, err := d.Parse(context.Background(), "ok"); err != nil {
+		t.Fatal(err)
+	}
+	if d.gen != gen+1 {
+		t.Fatalf("expected the parser to be restarted, generation: %d -> %d", gen, d.gen)
+	}
+}
+
+func TestCachedParseBatch(t *testing.T) {
+	d, closer := newFakeDriver(t)
+	defer closer()
+	nat := NewCache(10, nil).Native(d).(batchParser)
+	ctx := context.Background()
+
+	files := []File{{Path: "a.cs", Content: "file1"}, {Path: "b.cs", Content: "file2"}}
+	for _, r := range collectResults(t, nat.ParseBatch(ctx, files)) {
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+	}
+	// cached files are not sent to the native parser
+	d.Close()
+	files = []File{files[1], {Path: "c.cs", Content: "file3"}, files[0]}
+	res := collectResults(t, nat.ParseBatch(ctx, files))
+	if len(res) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(res))
+	}
+	checkContent(t, res[0], "file2")
+	if err := res[1].Err; !native.ErrNotRunning.Is(err) || !driver.ErrDriverFailure.Is(err) {
+		t.Fatalf("expected the parser to be stopped, got: %v", err)
+	}
+	checkContent(t, res[2], "file1")
+	for i, r := range res {
+		if r.Path != files[i].Path {
+			t.Fatalf("unexpected order: %q at %d", r.Path, i)
+		}
+	}
+}
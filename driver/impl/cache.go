@@ -0,0 +1,435 @@
+package impl
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bblfsh/sdk/v3/driver"
+	"github.com/bblfsh/sdk/v3/driver/manifest"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	"github.com/bblfsh/sdk/v3/uast/nodes/nodesproto"
+)
+
+const (
+	// envCacheSize is the name of an environment variable with the number of parse results
+	// kept in memory by the cache.
+	envCacheSize = "CSHARP_DRIVER_CACHE_SIZE"
+	// envCacheDir is the name of an environment variable with the directory of the on-disk cache.
+	envCacheDir = "CSHARP_DRIVER_CACHE_DIR"
+
+	// defaultCacheSize is the number of parse results kept in memory, if only the on-disk cache is enabled.
+	defaultCacheSize = 1024
+)
+
+// Store is a persistent storage of cached parse results. It must be safe for concurrent use.
+type Store interface {
+	// Get returns data stored for the key. It returns false if the key is not found.
+	Get(key string) ([]byte, bool, error)
+	// Put stores data for the key.
+	Put(key string, data []byte) error
+}
+
+var _ Store = DirStore("")
+
+// DirStore is a Store that keeps each parse result in a separate file in the directory.
+type DirStore string
+
+func (s DirStore) path(key string) string {
+	return filepath.Join(string(s), key[:2], key)
+}
+
+// Get implements Store.
+func (s DirStore) Get(key string) ([]byte, bool, error) {
+	data, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// Put implements Store.
+func (s DirStore) Put(key string, data []byte) error {
+	path := s.path(key)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// write to a temporary file first, so concurrent readers never see a partial file
+	f, err := ioutil.TempFile(dir, key+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Cache is a content-addressed cache of parse results. It's safe for concurrent use.
+//
+// Results are keyed by the hash of the source code, parse options (see WithParseOptions) and
+// the driver version. Recently used results are kept in memory, and all results are persisted
+// in the Store, if it's set. Only successful results are cached; errors of the Store are ignored.
+//
+// The size limit of the request is checked against the size of the native AST the result was
+// parsed from, thus cache hits fail with ErrTooLarge the same way as the native parser does. Cache
+// hits fail with ErrTimeout, if the lookup exceeds the timeout of the request.
+//
+// Cached nodes are shared between requests and must not be modified.
+type Cache struct {
+	// Version is a version of the driver. Results cached with different versions are never mixed.
+	Version string
+
+	store Store
+
+	mu    sync.Mutex
+	size  int
+	items map[string]*list.Element
+	lru   *list.List // of *cacheEntry, most recently used first
+}
+
+type cacheEntry struct {
+	key  string
+	node nodes.Node
+	size int // size of the native AST the result was parsed from; zero if unknown
+}
+
+// NewCache creates a cache that keeps up to size results in memory. Results are also persisted
+// in the store, if it's not nil.
+//
+// The version of the driver is taken from the driver manifest, or from the modification time
+// of the driver binary, if the manifest is not available.
+func NewCache(size int, store Store) *Cache {
+	return &Cache{
+		Version: driverVersion(),
+		store:   store,
+		size:    size,
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// NewCacheFromEnv creates a cache configured with environment variables of the driver
+// (CSHARP_DRIVER_CACHE_SIZE and CSHARP_DRIVER_CACHE_DIR). It returns nil, if the cache is disabled.
+func NewCacheFromEnv() *Cache {
+	size, _ := strconv.Atoi(os.Getenv(envCacheSize))
+	var store Store
+	if dir := os.Getenv(envCacheDir); dir != "" {
+		store = DirStore(dir)
+		if size <= 0 {
+			size = defaultCacheSize
+		}
+	}
+	if size <= 0 {
+		return nil
+	}
+	return NewCache(size, store)
+}
+
+// driverVersion returns a version of the driver used in cache keys.
+func driverVersion() string {
+	if m, err := manifest.Load(driver.ManifestLocation); err == nil && m.Version != "" {
+		return m.Version + " " + m.Build.String()
+	}
+	if exe, err := os.Executable(); err == nil {
+		if fi, err := os.Stat(exe); err == nil {
+			return fi.ModTime().String()
+		}
+	}
+	return ""
+}
+
+// key returns a hash of all the parts of the key.
+func (c *Cache) key(parts ...string) string {
+	h := sha256.New()
+	var n [8]byte
+	for _, p := range append([]string{c.Version}, parts...) {
+		binary.LittleEndian.PutUint64(n[:], uint64(len(p)))
+		h.Write(n[:])
+		h.Write([]byte(p))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// optionsKey returns the part of the cache key for parse options that affect the result.
+func optionsKey(opts ParseOptions) string {
+	return fmt.Sprintf("%q %q", opts.symbolSets(), opts.LanguageVersion)
+}
+
+// Get returns a cached parse result.
+func (c *Cache) Get(key string) (nodes.Node, bool) {
+	e, ok := c.get(key)
+	if !ok {
+		return nil, false
+	}
+	return e.node, true
+}
+
+// Put adds a parse result to the cache.
+func (c *Cache) Put(key string, n nodes.Node) {
+	c.put(&cacheEntry{key: key, node: n})
+}
+
+// get returns a cached entry. Entries read from the store are added to the in-memory cache.
+func (c *Cache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	if e, ok := c.items[key]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*cacheEntry), true
+	}
+	c.mu.Unlock()
+	if c.store == nil {
+		return nil, false
+	}
+	data, ok, err := c.store.Get(key)
+	if err != nil || !ok {
+		return nil, false
+	}
+	// the size of the native AST is stored before the tree
+	size, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, false
+	}
+	node, err := nodesproto.ReadTree(bytes.NewReader(data[n:]))
+	if err != nil {
+		return nil, false
+	}
+	e := &cacheEntry{key: key, node: node, size: int(size)}
+	c.add(e)
+	return e, true
+}
+
+// put adds an entry to the cache.
+func (c *Cache) put(e *cacheEntry) {
+	c.add(e)
+	if c.store == nil {
+		return
+	}
+	buf := new(bytes.Buffer)
+	var hdr [binary.MaxVarintLen64]byte
+	buf.Write(hdr[:binary.PutUvarint(hdr[:], uint64(e.size))])
+	if err := nodesproto.WriteTo(buf, e.node); err != nil {
+		return
+	}
+	_ = c.store.Put(e.key, buf.Bytes())
+}
+
+// add adds an entry to the in-memory cache, evicting the least recently used entries.
+func (c *Cache) add(ent *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[ent.key]; ok {
+		c.lru.MoveToFront(e)
+		e.Value = ent
+		return
+	}
+	c.items[ent.key] = c.lru.PushFront(ent)
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.items, e.Value.(*cacheEntry).key)
+	}
+}
+
+// Native wraps the native driver to cache native ASTs. Cache hits don't send requests
+// to the native parser.
+func (c *Cache) Native(d driver.Native) driver.Native {
+	return &cachedNative{Native: d, c: c}
+}
+
+// Driver wraps the driver to cache results of each transformation mode. Cache hits don't send
+// requests to the native parser and don't run transformations. It can be used by custom servers
+// that create the driver with driver.NewDriverFrom; the server of the SDK caches only native ASTs.
+//
+// The version reported by the driver and the schema of native ASTs of its native driver are added
+// to the cache key. The schema defaults to SchemaFull, if not set.
+func (c *Cache) Driver(d driver.DriverModule, schema Schema) driver.DriverModule {
+	if schema == "" {
+		schema = SchemaFull
+	}
+	return &cachedDriver{DriverModule: d, c: c, schema: schema}
+}
+
+type cachedNative struct {
+	driver.Native
+	c *Cache
+}
+
+// schema returns the schema of native ASTs produced by the driver.
+func (d *cachedNative) schema() Schema {
+	var s Schema
+	switch n := d.Native.(type) {
+	case *Driver:
+		s = n.Schema
+	case *Pool:
+		s = n.Schema
+	}
+	if s == "" {
+		s = SchemaFull
+	}
+	return s
+}
+
+// Parse implements driver.Native.
+func (d *cachedNative) Parse(ctx context.Context, src string) (nodes.Node, error) {
+	opts := parseOptionsFrom(ctx)
+	key := d.c.key("native", string(d.schema()), optionsKey(opts), src)
+	start := time.Now()
+	if e, ok := d.c.get(key); ok {
+		if err := checkLimits(opts, e.size, start); err != nil {
+			return nil, err
+		}
+		recordNativeSize(ctx, e.size)
+		return e.node, nil
+	}
+	ctx, size := withNativeSize(ctx)
+	n, err := d.Native.Parse(ctx, src)
+	if err == nil {
+		d.c.put(&cacheEntry{key: key, node: n, size: size.max})
+	}
+	return n, err
+}
+
+// ParseBatch parses files the same way as Pool.ParseBatch. Only files that are not in the cache
+// are sent to the native parser.
+func (d *cachedNative) ParseBatch(ctx context.Context, files []File) <-chan FileResult {
+	out := make(chan FileResult)
+	go func() {
+		defer close(out)
+		opts := parseOptionsFrom(ctx)
+		schema, okey := string(d.schema()), optionsKey(opts)
+		keys := make([]string, len(files))
+		hits := make([]*FileResult, len(files))
+		var misses []File
+		for i, f := range files {
+			keys[i] = d.c.key("native", schema, okey, f.Content)
+			start := time.Now()
+			e, ok := d.c.get(keys[i])
+			if !ok {
+				misses = append(misses, f)
+				continue
+			}
+			res := &FileResult{Path: f.Path, AST: e.node, size: e.size}
+			if err := checkLimits(opts, e.size, start); err != nil {
+				res = &FileResult{Path: f.Path, Err: err}
+			}
+			hits[i] = res
+		}
+		var parsed <-chan FileResult
+		if len(misses) != 0 {
+			parsed = parseBatch(ctx, d.Native, misses)
+		}
+		for i, res := range hits {
+			if res == nil {
+				r, ok := <-parsed
+				if !ok {
+					// the context was canceled
+					return
+				}
+				if r.Err == nil {
+					d.c.put(&cacheEntry{key: keys[i], node: r.AST, size: r.size})
+				}
+				res = &r
+			}
+			if !send(ctx, *res, out) {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+type cachedDriver struct {
+	driver.DriverModule
+	c      *Cache
+	schema Schema
+}
+
+// Parse implements driver.Driver.
+func (d *cachedDriver) Parse(ctx context.Context, src string, opts *driver.ParseOptions) (nodes.Node, error) {
+	vers, err := d.Version(ctx)
+	if err != nil {
+		return d.DriverModule.Parse(ctx, src, opts)
+	}
+	mode := driver.ModeDefault
+	if opts != nil && opts.Mode != 0 {
+		mode = opts.Mode
+	}
+	popts := parseOptionsFrom(ctx)
+	key := d.c.key(
+		"mode "+strconv.Itoa(int(mode)), vers.Version, vers.Build.String(),
+		string(d.schema), optionsKey(popts), src,
+	)
+	start := time.Now()
+	if e, ok := d.c.get(key); ok {
+		if err := checkLimits(popts, e.size, start); err != nil {
+			return nil, err
+		}
+		return e.node, nil
+	}
+	ctx, size := withNativeSize(ctx)
+	n, err := d.DriverModule.Parse(ctx, src, opts)
+	if err == nil {
+		d.c.put(&cacheEntry{key: key, node: n, size: size.max})
+	}
+	return n, err
+}
+
+// checkLimits checks the parse options of the request against a cache hit. The size of the native AST
+// is checked only if it's known.
+func checkLimits(opts ParseOptions, size int, start time.Time) error {
+	if opts.MaxSize > 0 && size > opts.MaxSize {
+		return driver.ErrDriverFailure.Wrap(ErrTooLarge.New(opts.MaxSize))
+	}
+	if opts.Timeout > 0 && time.Since(start) > opts.Timeout {
+		return driver.ErrDriverFailure.Wrap(ErrTimeout.New())
+	}
+	return nil
+}
+
+// nativeSizeKey is a context key for nativeSize.
+type nativeSizeKey struct{}
+
+// nativeSize is the size of the largest native AST received while handling a request.
+type nativeSize struct {
+	max int
+}
+
+// withNativeSize returns a context that records sizes of native ASTs (see recordNativeSize).
+// Nested calls return the same record.
+func withNativeSize(ctx context.Context) (context.Context, *nativeSize) {
+	if s, ok := ctx.Value(nativeSizeKey{}).(*nativeSize); ok {
+		return ctx, s
+	}
+	s := &nativeSize{}
+	return context.WithValue(ctx, nativeSizeKey{}, s), s
+}
+
+// recordNativeSize records the size of the native AST received for the request, if the context
+// has a record (see withNativeSize).
+func recordNativeSize(ctx context.Context, size int) {
+	if s, ok := ctx.Value(nativeSizeKey{}).(*nativeSize); ok && size > s.max {
+		s.max = size
+	}
+}
@@ -0,0 +1,176 @@
+package impl
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bblfsh/sdk/v3/driver"
+	"github.com/bblfsh/sdk/v3/driver/manifest"
+	"github.com/bblfsh/sdk/v3/driver/native"
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+)
+
+func TestCacheLRU(t *testing.T) {
+	c := NewCache(2, nil)
+	c.Put("a", nodes.String("a"))
+	c.Put("b", nodes.String("b"))
+	// "a" becomes the most recently used, thus "b" is evicted
+	if n, ok := c.Get("a"); !ok || n != nodes.String("a") {
+		t.Fatalf("unexpected result: %v, %v", n, ok)
+	}
+	c.Put("c", nodes.String("c"))
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("expected the least recently used result to be evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if n, ok := c.Get(k); !ok || n != nodes.String(k) {
+			t.Fatalf("unexpected result for %q: %v, %v", k, n, ok)
+		}
+	}
+	// updating a result doesn't evict others
+	c.Put("c", nodes.String("d"))
+	if n, ok := c.Get("c"); !ok || n != nodes.String("d") {
+		t.Fatalf("unexpected result: %v, %v", n, ok)
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("expected the result to be kept")
+	}
+}
+
+func TestDirStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csharp-driver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := DirStore(dir)
+
+	key := NewCache(1, nil).key("src")
+	if _, ok, err := s.Get(key); err != nil || ok {
+		t.Fatalf("expected a missing key, got: %v, %v", ok, err)
+	}
+	if err = s.Put(key, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	data, ok, err := s.Get(key)
+	if err != nil || !ok || string(data) != "data" {
+		t.Fatalf("unexpected result: %q, %v, %v", data, ok, err)
+	}
+	// temporary files are not left behind
+	files, _ := filepath.Glob(filepath.Join(dir, key[:2], "*"))
+	if len(files) != 1 {
+		t.Fatalf("unexpected files: %q", files)
+	}
+
+	// results are persisted with the size of the native AST
+	ast := nodes.Object{uast.KeyType: nodes.String("CompilationUnit"), "Members": nodes.Array{nodes.Int(1)}}
+	c := NewCache(1, s)
+	key = c.key("class A {}")
+	c.put(&cacheEntry{key: key, node: ast, size: 42})
+	e, ok := NewCache(1, s).get(key)
+	if !ok {
+		t.Fatal("expected the result to be read from the store")
+	} else if !nodes.Equal(e.node, ast) || e.size != 42 {
+		t.Fatalf("unexpected result: %v, %d", e.node, e.size)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	c := NewCache(1, nil)
+	c.Version = "v1"
+	if c.key("a", "b") != c.key("a", "b") {
+		t.Fatal("expected the same key")
+	}
+	keys := map[string]string{
+		"parts":     c.key("a", "b"),
+		"boundary":  c.key("ab", ""),
+		"nested":    c.key("a", "b", ""),
+		"reordered": c.key("b", "a"),
+	}
+	c.Version = "v2"
+	keys["version"] = c.key("a", "b")
+	seen := make(map[string]string)
+	for name, k := range keys {
+		if prev, ok := seen[k]; ok {
+			t.Fatalf("keys %q and %q are the same", name, prev)
+		}
+		seen[k] = name
+	}
+
+	// only options that affect the native AST are in the key
+	opts := ParseOptions{Symbols: []string{"DEBUG"}, LanguageVersion: "7.3"}
+	key := optionsKey(opts)
+	if k := optionsKey(ParseOptions{Symbols: opts.Symbols, LanguageVersion: opts.LanguageVersion, Timeout: time.Second, MaxSize: 10}); k != key {
+		t.Fatalf("unexpected key: %q != %q", k, key)
+	}
+	for _, o := range []ParseOptions{
+		{LanguageVersion: "7.3"},
+		{Symbols: []string{"DEBUG"}},
+		{Symbols: []string{"DEBUG"}, LanguageVersion: "7.3", SymbolSets: [][]string{{"NET45"}}},
+	} {
+		if k := optionsKey(o); k == key {
+			t.Fatalf("expected a different key for %+v", o)
+		}
+	}
+}
+
+func TestCacheLimits(t *testing.T) {
+	d, closer := newFakeDriver(t)
+	defer closer()
+	c := NewCache(1, nil)
+	nat := c.Native(d)
+
+	ctx := context.Background()
+	if _, err := nat.Parse(ctx, "large"); err != nil {
+		t.Fatal(err)
+	}
+	// cache hits don't send requests to the native parser
+	d.Close()
+	if _, err := nat.Parse(ctx, "large"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := nat.Parse(WithParseOptions(ctx, ParseOptions{MaxSize: 4096}), "large")
+	if !ErrTooLarge.Is(err) || !driver.ErrDriverFailure.Is(err) {
+		t.Fatalf("expected the AST to be too large, got: %v", err)
+	}
+	if _, err = nat.Parse(WithParseOptions(ctx, ParseOptions{MaxSize: 16384}), "large"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCachedDriver(t *testing.T) {
+	d, closer := newFakeDriver(t)
+	defer closer()
+	dm, err := driver.NewDriverFrom(d, &manifest.Manifest{Version: "v1"}, driver.Transforms{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCache(10, nil)
+	full, lean := c.Driver(dm, ""), c.Driver(dm, SchemaLean)
+
+	ctx := context.Background()
+	exp, err := full.Parse(ctx, "file1", &driver.ParseOptions{Mode: driver.ModeNative})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cache hits don't send requests to the native parser
+	d.Close()
+	n, err := full.Parse(ctx, "file1", &driver.ParseOptions{Mode: driver.ModeNative})
+	if err != nil {
+		t.Fatal(err)
+	} else if !nodes.Equal(n, exp) {
+		t.Fatalf("unexpected AST: %v", n)
+	}
+	// results of other modes and schemas are cached separately
+	if _, err = full.Parse(ctx, "file1", &driver.ParseOptions{Mode: driver.ModeSemantic}); !native.ErrNotRunning.Is(err) {
+		t.Fatalf("expected the parser to be stopped, got: %v", err)
+	}
+	if _, err = lean.Parse(ctx, "file1", &driver.ParseOptions{Mode: driver.ModeNative}); !native.ErrNotRunning.Is(err) {
+		t.Fatalf("expected the parser to be stopped, got: %v", err)
+	}
+}
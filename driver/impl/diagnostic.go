@@ -0,0 +1,164 @@
+package impl
+
+import (
+	"sort"
+	"unicode/utf8"
+
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+)
+
+// Severity of the diagnostic reported by the parser.
+type Severity string
+
+const (
+	SeverityError   = Severity("Error")
+	SeverityWarning = Severity("Warning")
+)
+
+// nativeDiagnostic is a diagnostic as reported by the native parser.
+type nativeDiagnostic struct {
+	ID       string   `json:"id"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+	// UTF-16 offsets of the diagnostic span
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+const (
+	// keyDiagnostics is a field of the root node of the native AST with diagnostics
+	// reported by the parser.
+	keyDiagnostics = "Diagnostics"
+	// typeDiagnostic is a type of native nodes that store diagnostics.
+	typeDiagnostic = "Diagnostic"
+)
+
+// Diagnostic is a syntax error or a warning reported by the C# parser.
+//
+// Diagnostics never fail the Parse call and the response status is always "ok", since the parser
+// recovers from syntax errors and the SDK would otherwise return the native AST untransformed.
+// Instead, diagnostics are stored in the Diagnostics field of the root node of the native AST,
+// with the same positional information as other native nodes. Clients can tell a clean parse from
+// an error-recovered one by checking this field (see Diagnostics). In the semantic mode, nodes
+// that contain errors are also marked with the Erroneous field, and nodes inserted by the parser
+// are replaced with placeholders (see the normalizer package).
+type Diagnostic struct {
+	// ID of the diagnostic, for example CS1002.
+	ID       string
+	Severity Severity
+	Message  string
+	// Start and End are the positions of the source code span the diagnostic refers to.
+	Start uast.Position
+	End   uast.Position
+}
+
+// withDiagnostics stores native diagnostics in the root node of the native AST.
+// Offsets are left as-is, and are converted to positions by transformations, the same way as
+// for other native nodes.
+func withDiagnostics(ast nodes.Node, diags []nativeDiagnostic) nodes.Node {
+	root, ok := ast.(nodes.Object)
+	if !ok || len(diags) == 0 {
+		return ast
+	}
+	arr := make(nodes.Array, 0, len(diags))
+	for _, d := range diags {
+		sp := nodes.Object{
+			uast.KeyType: nodes.String("TextSpan"),
+			"Start":      nodes.Int(d.Start),
+			"End":        nodes.Int(d.End),
+			"Length":     nodes.Int(d.End - d.Start),
+		}
+		arr = append(arr, nodes.Object{
+			uast.KeyType: nodes.String(typeDiagnostic),
+			"Id":         nodes.String(d.ID),
+			"Severity":   nodes.String(d.Severity),
+			"Message":    nodes.String(d.Message),
+			"Span":       sp,
+			"FullSpan":   sp,
+		})
+	}
+	root = root.CloneObject()
+	root[keyDiagnostics] = arr
+	return root
+}
+
+// Diagnostics returns diagnostics stored in the root node of the native AST returned by the driver.
+// Positions are calculated for the given source. It returns nil if the file was parsed without errors
+// and warnings.
+func Diagnostics(src string, ast nodes.Node) []*Diagnostic {
+	root, _ := ast.(nodes.Object)
+	arr, _ := root[keyDiagnostics].(nodes.Array)
+	if len(arr) == 0 {
+		return nil
+	}
+	var (
+		diags = make([]nativeDiagnostic, 0, len(arr))
+		offs  = make([]int, 0, 2*len(arr))
+	)
+	for _, n := range arr {
+		obj, _ := n.(nodes.Object)
+		sp, _ := spanOf(obj, "Span")
+		id, _ := obj["Id"].(nodes.String)
+		sev, _ := obj["Severity"].(nodes.String)
+		msg, _ := obj["Message"].(nodes.String)
+		diags = append(diags, nativeDiagnostic{
+			ID: string(id), Severity: Severity(sev), Message: string(msg),
+			Start: int(sp.start), End: int(sp.end),
+		})
+		offs = append(offs, int(sp.start), int(sp.end))
+	}
+	pos := utf16Positions(src, offs)
+	out := make([]*Diagnostic, 0, len(diags))
+	for _, d := range diags {
+		out = append(out, &Diagnostic{
+			ID:       d.ID,
+			Severity: d.Severity,
+			Message:  d.Message,
+			Start:    pos[d.Start],
+			End:      pos[d.End],
+		})
+	}
+	return out
+}
+
+// utf16Positions converts UTF-16 offsets used by Roslyn to byte positions in the UTF-8 source.
+func utf16Positions(src string, offs []int) map[int]uast.Position {
+	out := make(map[int]uast.Position, len(offs))
+	if len(offs) == 0 {
+		return out
+	}
+	sorted := append([]int{}, offs...)
+	sort.Ints(sorted)
+
+	cur := uast.Position{Offset: 0, Line: 1, Col: 1}
+	off16 := 0
+	for i := 0; ; {
+		for len(sorted) != 0 && sorted[0] <= off16 {
+			out[sorted[0]] = cur
+			sorted = sorted[1:]
+		}
+		if len(sorted) == 0 || i >= len(src) {
+			break
+		}
+		r, n := utf8.DecodeRuneInString(src[i:])
+		if r >= 0x10000 {
+			off16 += 2 // surrogate pair
+		} else {
+			off16++
+		}
+		i += n
+		cur.Offset += uint32(n)
+		if r == '\n' {
+			cur.Line++
+			cur.Col = 1
+		} else {
+			cur.Col += uint32(n)
+		}
+	}
+	// offsets past the end of the file
+	for _, off := range sorted {
+		out[off] = cur
+	}
+	return out
+}
@@ -0,0 +1,55 @@
+package impl
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+)
+
+func TestDiagnostics(t *testing.T) {
+	// the string literal has a character outside of the BMP, thus UTF-16 offsets of the
+	// second line are different from byte offsets
+	const src = "var s = \"\U0001F600é\";\nvar x = ;\n"
+	root := nodes.Object{uast.KeyType: nodes.String("CompilationUnit")}
+
+	if got := withDiagnostics(root, nil); !reflect.DeepEqual(got, root) {
+		t.Fatalf("unexpected AST without diagnostics: %v", got)
+	}
+	if got := Diagnostics(src, root); got != nil {
+		t.Fatalf("unexpected diagnostics: %v", got)
+	}
+
+	ast := withDiagnostics(root, []nativeDiagnostic{
+		{ID: "CS1525", Severity: SeverityError, Message: "Invalid expression term ';'", Start: 23, End: 24},
+		{ID: "CS1030", Severity: SeverityWarning, Message: "#warning: 'x'", Start: 0, End: 3},
+	})
+	if _, ok := root[keyDiagnostics]; ok {
+		t.Fatal("the original AST must not be modified")
+	}
+	diags, ok := ast.(nodes.Object)[keyDiagnostics].(nodes.Array)
+	if !ok || len(diags) != 2 {
+		t.Fatalf("expected diagnostics in the root node: %v", ast)
+	}
+	if typ := uast.TypeOf(diags[0]); typ != typeDiagnostic {
+		t.Fatalf("unexpected node type: %q", typ)
+	}
+
+	exp := []*Diagnostic{
+		{
+			ID: "CS1525", Severity: SeverityError, Message: "Invalid expression term ';'",
+			Start: uast.Position{Offset: 26, Line: 2, Col: 9},
+			End:   uast.Position{Offset: 27, Line: 2, Col: 10},
+		},
+		{
+			ID: "CS1030", Severity: SeverityWarning, Message: "#warning: 'x'",
+			Start: uast.Position{Offset: 0, Line: 1, Col: 1},
+			End:   uast.Position{Offset: 3, Line: 1, Col: 4},
+		},
+	}
+	got := Diagnostics(src, ast)
+	if !reflect.DeepEqual(exp, got) {
+		t.Fatalf("unexpected diagnostics:\n%v\nvs\n%v", exp, got)
+	}
+}
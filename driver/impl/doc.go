@@ -0,0 +1,71 @@
+// Package impl contains the native driver implementation for C#.
+//
+// By default, files are parsed with the default C# language version of the parser and without
+// any preprocessor symbols defined, thus the code under "#if DEBUG" is treated as disabled text.
+// Default options can be set with environment variables of the driver:
+//
+//	CSHARP_DRIVER_LANG_VERSION - a C# language version, in the same format as LangVersion project
+//	                             property, e.g. "7.3" or "latest". The effective version is reported
+//	                             in the LanguageVersion field of the root node.
+//	CSHARP_DRIVER_SYMBOLS      - a list of symbols separated by semicolons, e.g. "DEBUG;TRACE".
+//	CSHARP_DRIVER_SYMBOL_SETS  - a list of symbol sets separated by '|', e.g. "NETCOREAPP|NETFRAMEWORK;NET45".
+//	                             The file is parsed once per set and the code that is disabled with
+//	                             the first set, but enabled with the other sets, is added to the
+//	                             Variants field of the root node.
+//	CSHARP_DRIVER_TIMEOUT      - a timeout for a single parse request, e.g. "30s".
+//	CSHARP_DRIVER_MAX_SIZE     - a limit of the native AST size in bytes.
+//
+// If the native parser exceeds the timeout, the request fails with ErrTimeout and the parser is
+// restarted, so the following requests are not affected. If the native AST exceeds the size limit,
+// the request fails with ErrTooLarge. The limit is enforced by the native parser, thus large ASTs
+// are not sent to the driver at all; the driver still checks the size of responses it reads.
+//
+// Files with syntax errors are still parsed, since the parser recovers from errors, and the response
+// has no errors. Syntax errors and warnings are reported in the Diagnostics field of the root node of
+// the native AST (see Diagnostic). Semantic nodes that contain syntax errors are marked as Erroneous.
+//
+// The native parser sends ASTs in JSON by default. A more compact MessagePack encoding can be
+// enabled with CSHARP_DRIVER_WIRE_FORMAT=msgpack (see WireFormat). It reduces the serialization
+// and decoding cost on big files.
+//
+// Native ASTs include all fields of Roslyn nodes by default. Redundant fields can be omitted with
+// CSHARP_DRIVER_SCHEMA=lean (see SchemaLean). It reduces the size of native ASTs, but clients of
+// NativeParse will receive ASTs in a different schema.
+//
+// Parse results can be cached (see Cache). The cache is enabled with CSHARP_DRIVER_CACHE_SIZE, the number
+// of native ASTs kept in memory, and with CSHARP_DRIVER_CACHE_DIR, a directory to persist native ASTs in.
+// Cached files are not sent to the native parser. Size limits and timeouts of requests apply to cached
+// results as well. The gRPC server caches only native ASTs, thus cached files are still transformed.
+// Custom servers can also cache UASTs for each transformation mode with Cache.Driver.
+//
+// The driver runs a pool of native parsers to parse files concurrently (see Pool). The size of
+// the pool is set with CSHARP_DRIVER_WORKERS environment variable and defaults to a single parser.
+//
+// Options can also be set for each request. Clients of the gRPC server can send them in the request
+// metadata, with the same format as the environment variables:
+//
+//	csharp-lang-version, csharp-symbols, csharp-symbol-sets, csharp-timeout, csharp-max-size
+//
+// When the driver is used as a Go library, options can be set with WithParseOptions. Options that
+// are not set for the request are taken from the environment. The timeout and the size limit of
+// the request can't exceed the ones set in the environment, thus clients can only lower them.
+//
+// Many files can be parsed with a single request to the native parser with ParseBatch, which streams
+// results for each file back in order. It avoids the per-request overhead when indexing a lot of files.
+// Files found in the cache are not sent to the native parser. Clients of the gRPC server can send files
+// in a stream (see RegisterBatchService). The stream is served on a separate address set with
+// CSHARP_DRIVER_BATCH_ADDRESS, e.g. "0.0.0.0:9433", since the server of the SDK can't serve other services.
+//
+// Documents that are edited often, for example in an editor, can be parsed incrementally (see Document).
+// Only the changed text is sent to the native parser, and unchanged members are not sent back.
+// Note that for code with syntax errors the incremental parser may recover from errors differently
+// than when the file is parsed from scratch. Clients of the gRPC server can use it by setting an id
+// of the document in the csharp-document metadata key. Ids are scoped to the client connection. The whole
+// text is still sent with each request, but only the changed part of it is reparsed. The driver keeps
+// at most 64 documents and closes documents that are not used for 10 minutes; the native parser
+// follows these evictions and has no limits of its own.
+//
+// Only the parsing is incremental for clients of the gRPC server: the server of the SDK transforms the
+// whole native AST of the document on each request. When the driver is used as a Go library,
+// Document.Transform transforms only the members that have changed since the last call.
+package impl
@@ -0,0 +1,534 @@
+package impl
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bblfsh/sdk/v3/driver"
+	"github.com/bblfsh/sdk/v3/driver/native"
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	// typeReusedNode is a type of the node sent by the native parser instead of a member
+	// that is the same as in the previous AST of the document.
+	typeReusedNode = "ReusedNode"
+
+	// metadataDocument is a gRPC metadata key with an id of the document the file belongs to.
+	// See documentSet.
+	metadataDocument = "csharp-document"
+	// maxDocuments is the maximal number of documents opened by clients of the gRPC server.
+	// If a new document exceeds it, the least recently used document is closed.
+	maxDocuments = 64
+	// documentTTL is the time after which the document opened by a client of the gRPC server
+	// is closed, if it's not used.
+	documentTTL = 10 * time.Minute
+)
+
+// lastDocument is the last id assigned to a document.
+var lastDocument uint64
+
+// Edit is a change of the document text.
+type Edit struct {
+	// Start and End are byte offsets of the replaced text. All edits passed to Document.Edit
+	// refer to the text before the edits are applied.
+	Start, End int
+	// Text is the new text of the span.
+	Text string
+}
+
+// textEdit is an edit as sent to the native parser, with UTF-16 offsets.
+type textEdit struct {
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	Text  string `json:"text"`
+}
+
+// Document is a source file that is parsed incrementally, for example when it's being edited.
+//
+// The native parser keeps the syntax tree of the document between requests and reparses only
+// the changed parts of it. Members (namespaces, types, methods, etc) that are not affected by
+// the edits are not sent again: the driver reuses their native AST from the previous request.
+// Transform can be used to transform only the changed members of the AST.
+//
+// Parse options are taken from the context, the same way as for Driver.Parse, but only the first
+// symbol set is used. The document is parsed from scratch if options change, or if the native
+// parser was restarted since the last request.
+//
+// Document is not safe for concurrent use. It must be closed to release the tree in the native parser,
+// since the native parser keeps trees of documents until they are closed.
+type Document struct {
+	d    *Driver
+	pool *Pool
+	w    *worker
+	id   string
+
+	src  string
+	ast  nodes.Node // the last native AST; nil if the document must be parsed from scratch
+	gen  int        // generation of the native parser that has the tree of the document
+	opts string     // parse options of the tree
+
+	last    nodes.Node           // the last AST returned by Parse or Edit; nil if the parsing failed
+	members map[span]*uastMember // members of the last AST transformed separately, see Transform
+	mode    driver.Mode          // the mode members were transformed with
+}
+
+// NewDocument creates a new document that is parsed incrementally by the native parser.
+func (d *Driver) NewDocument() *Document {
+	return &Document{d: d, id: newDocumentID()}
+}
+
+// NewDocument creates a new document that is parsed incrementally. All requests for the document
+// are sent to the same native parser in the pool.
+func (p *Pool) NewDocument() *Document {
+	return &Document{pool: p, id: newDocumentID()}
+}
+
+func newDocumentID() string {
+	return strconv.FormatUint(atomic.AddUint64(&lastDocument, 1), 10)
+}
+
+// Source returns the current text of the document.
+func (doc *Document) Source() string {
+	return doc.src
+}
+
+// Parse sets the text of the document and parses it from scratch.
+// Results are the same as for Driver.Parse.
+func (doc *Document) Parse(ctx context.Context, src string) (nodes.Node, error) {
+	return doc.parse(ctx, src, nil)
+}
+
+// Edit applies edits to the text of the document and parses it incrementally.
+// Edits must be sorted by the position and must not overlap.
+//
+// The text is changed even if the parsing fails.
+func (doc *Document) Edit(ctx context.Context, edits ...Edit) (nodes.Node, error) {
+	src, native, err := applyEdits(doc.src, edits)
+	if err != nil {
+		return nil, err
+	}
+	return doc.parse(ctx, src, native)
+}
+
+// Close discards the tree of the document in the native parser.
+func (doc *Document) Close() error {
+	if doc.d == nil {
+		return nil
+	}
+	if err := doc.acquire(); err != nil {
+		return err
+	}
+	defer doc.release()
+	d := doc.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	doc.ast, doc.last, doc.members = nil, nil, nil
+	if !d.started || doc.gen != d.gen || d.broken {
+		// the tree is already lost
+		return nil
+	}
+	_, _, err := d.parse(context.Background(), &parseRequest{Document: doc.id, Close: true}, 0)
+	return err
+}
+
+// acquire reserves the native parser of the document for a request.
+func (doc *Document) acquire() error {
+	if doc.pool == nil {
+		return nil
+	}
+	if doc.w == nil {
+		w, err := doc.pool.acquire()
+		if err != nil {
+			return err
+		}
+		doc.w, doc.d = w, w.Driver
+		return nil
+	}
+	return doc.pool.acquireWorker(doc.w)
+}
+
+// release marks the request to the native parser of the document as finished.
+func (doc *Document) release() {
+	if doc.pool != nil {
+		doc.pool.release(doc.w)
+	}
+}
+
+// parse sends the document to the native parser. If edits are set and the native parser has
+// the tree of the previous text, the document is reparsed incrementally.
+func (doc *Document) parse(ctx context.Context, src string, edits []textEdit) (nodes.Node, error) {
+	doc.src = src
+	if err := doc.acquire(); err != nil {
+		return nil, err
+	}
+	defer doc.release()
+	d := doc.d
+	opts := parseOptionsFrom(ctx)
+	symbols := opts.symbolSets()[0]
+	key := strings.Join(symbols, ";") + "|" + opts.LanguageVersion
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.started {
+		return nil, driver.ErrDriverFailure.Wrap(native.ErrNotRunning.New())
+	}
+
+	if opts.Timeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	if err := d.revive(); err != nil {
+		return nil, err
+	}
+	for {
+		req := &parseRequest{
+			Content: src, Symbols: symbols, LanguageVersion: opts.LanguageVersion,
+			Document: doc.id,
+		}
+		incremental := len(edits) != 0 && doc.ast != nil && doc.gen == d.gen && doc.opts == key
+		if incremental {
+			req.Content, req.Edits = "", edits
+		}
+		prev, gen := doc.ast, d.gen
+		doc.ast, doc.last = nil, nil
+
+		ast, vers, err := d.parse(ctx, req, opts.MaxSize)
+		if incremental && (gen != d.gen || err == errUnknownDocument) {
+			// the parser was restarted or has closed the document, thus the tree is lost;
+			// parse from scratch
+			continue
+		}
+		// the parser may be restarted before it reads the request
+		doc.gen, doc.opts = d.gen, key
+		var reused []reusedMember
+		if incremental && ast != nil {
+			var ok bool
+			if ast, reused, ok = reuseNodes(ast, prev); !ok {
+				// should not happen, but it's safer to parse from scratch
+				continue
+			}
+		}
+		doc.ast = ast
+		doc.members = moveMembers(doc.members, reused)
+		ast = withLanguageVersion(ast, opts, vers)
+		if err == nil {
+			doc.last = ast
+		}
+		return ast, err
+	}
+}
+
+// applyEdits applies edits to the source and converts them to UTF-16 offsets used by the native parser.
+func applyEdits(src string, edits []Edit) (string, []textEdit, error) {
+	offs := make([]int, 0, 2*len(edits))
+	last := 0
+	for _, e := range edits {
+		if e.Start < last || e.End < e.Start || e.End > len(src) {
+			return "", nil, fmt.Errorf("invalid edit: [%d, %d)", e.Start, e.End)
+		}
+		for _, off := range []int{e.Start, e.End} {
+			if off < len(src) && !utf8.RuneStart(src[off]) {
+				return "", nil, fmt.Errorf("edit offset %d is inside a character", off)
+			}
+		}
+		offs = append(offs, e.Start, e.End)
+		last = e.End
+	}
+	offs16 := utf16Offsets(src, offs)
+
+	var buf strings.Builder
+	out := make([]textEdit, 0, len(edits))
+	last = 0
+	for i, e := range edits {
+		buf.WriteString(src[last:e.Start])
+		buf.WriteString(e.Text)
+		last = e.End
+		out = append(out, textEdit{Start: offs16[2*i], End: offs16[2*i+1], Text: e.Text})
+	}
+	buf.WriteString(src[last:])
+	return buf.String(), out, nil
+}
+
+// utf16Offsets converts sorted byte offsets in the UTF-8 source to UTF-16 offsets used by Roslyn.
+func utf16Offsets(src string, offs []int) []int {
+	out := make([]int, 0, len(offs))
+	i, off16 := 0, 0
+	for _, off := range offs {
+		for i < off {
+			r, n := utf8.DecodeRuneInString(src[i:])
+			if r >= 0x10000 {
+				off16 += 2 // surrogate pair
+			} else {
+				off16++
+			}
+			i += n
+		}
+		out = append(out, off16)
+	}
+	return out
+}
+
+// reusedMember is a member of the previous native AST reused in the new one.
+type reusedMember struct {
+	old   span  // full span of the member in the previous AST
+	shift int64 // the difference between new and old positions of the member
+}
+
+// reuseNodes replaces references to members of the previous native AST with the nodes from
+// that AST, shifting their positions. It returns false if a member cannot be found.
+func reuseNodes(ast, prev nodes.Node) (nodes.Node, []reusedMember, bool) {
+	var (
+		members map[span]nodes.Node
+		reused  []reusedMember
+	)
+	ok := true
+	out, _ := nodes.Apply(ast, func(n nodes.Node) (nodes.Node, bool) {
+		obj, isObj := n.(nodes.Object)
+		if !isObj || uast.TypeOf(obj) != typeReusedNode {
+			return n, false
+		}
+		if members == nil {
+			members = memberNodes(prev)
+		}
+		start, _ := intValue(obj["Start"])
+		length, _ := intValue(obj["Length"])
+		shift, _ := intValue(obj["Shift"])
+		sp := span{start: start, end: start + length}
+		m, found := members[sp]
+		if !found {
+			ok = false
+			return n, false
+		}
+		reused = append(reused, reusedMember{old: sp, shift: shift})
+		return shiftSpans(m, shift), true
+	})
+	if !ok {
+		return nil, nil, false
+	}
+	if defaults := mergeSchemaDefaults([]nodes.Node{out, prev}); defaults != nil {
+		out = withSchemaDefaults(out, defaults)
+	}
+	return out, reused, true
+}
+
+// memberNodes indexes members of namespaces and types in the native AST by their full span.
+func memberNodes(root nodes.Node) map[span]nodes.Node {
+	out := make(map[span]nodes.Node)
+	nodes.WalkPreOrder(root, func(n nodes.Node) bool {
+		obj, ok := n.(nodes.Object)
+		if !ok {
+			return true
+		}
+		members, _ := obj["Members"].(nodes.Array)
+		for _, m := range members {
+			if m, ok := m.(nodes.Object); ok {
+				if sp, ok := spanOf(m, "FullSpan"); ok {
+					out[sp] = m
+				}
+			}
+		}
+		return true
+	})
+	return out
+}
+
+// shiftSpans returns a copy of the native AST with all positions shifted by delta.
+func shiftSpans(n nodes.Node, delta int64) nodes.Node {
+	if delta == 0 {
+		return n
+	}
+	switch n := n.(type) {
+	case nodes.Object:
+		typ := uast.TypeOf(n)
+		if typ == "None" {
+			// optional tokens that are not present in the source always have a zero position
+			return n
+		}
+		isSpan := typ == "TextSpan"
+		out := make(nodes.Object, len(n))
+		for k, v := range n {
+			if k == "SpanStart" || (isSpan && (k == "Start" || k == "End")) {
+				if off, ok := intValue(v); ok {
+					out[k] = nodes.Int(off + delta)
+					continue
+				}
+			}
+			out[k] = shiftSpans(v, delta)
+		}
+		return out
+	case nodes.Array:
+		out := make(nodes.Array, 0, len(n))
+		for _, v := range n {
+			out = append(out, shiftSpans(v, delta))
+		}
+		return out
+	}
+	return n
+}
+
+// documentID returns the id of the document from gRPC metadata of the request, if it's set.
+// Ids are scoped to the connection of the client, thus clients can't use documents of each other.
+func documentID(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	vals := md.Get(metadataDocument)
+	if len(vals) == 0 || vals[0] == "" {
+		return ""
+	}
+	id := vals[0]
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		id = p.Addr.String() + "/" + id
+	}
+	return id
+}
+
+// documentSet is a set of documents opened by clients of the gRPC server.
+//
+// Clients can't send edits with the bblfsh protocol. Instead, they set an id of the document in
+// the request metadata (see metadataDocument) and send the whole text. The text is compared with
+// the previous text of the document with the same id, and only the changed part is sent to the
+// native parser (see Document). Only the parsing is incremental: the server of the SDK transforms
+// the whole native AST, since transformations run after Driver.Parse returns.
+//
+// The number of documents is limited, and documents that are not used are closed. The native parser
+// doesn't evict documents on its own, thus these are the only limits of open documents.
+type documentSet struct {
+	max int
+	ttl time.Duration
+
+	mu   sync.Mutex
+	docs map[string]*openDocument
+	wg   sync.WaitGroup // documents that are being closed
+}
+
+// openDocument is a document opened by a client of the gRPC server.
+type openDocument struct {
+	mu     sync.Mutex
+	doc    *Document
+	closed bool      // protected by the document mutex
+	used   time.Time // protected by the set mutex
+}
+
+func newDocumentSet() *documentSet {
+	return &documentSet{max: maxDocuments, ttl: documentTTL}
+}
+
+// parse parses the new text of the document with a given id. If the document is not open,
+// it is created with newDoc.
+func (s *documentSet) parse(ctx context.Context, id, src string, newDoc func() *Document) (nodes.Node, error) {
+	for {
+		od := s.get(id, newDoc)
+		od.mu.Lock()
+		if od.closed {
+			// the document was closed while we were waiting for it
+			od.mu.Unlock()
+			continue
+		}
+		ast, err := od.doc.Edit(ctx, diffText(od.doc.Source(), src)...)
+		od.mu.Unlock()
+		return ast, err
+	}
+}
+
+// get returns the open document with a given id, or creates a new one. Documents that expired, and
+// the least recently used document, if there are too many of them, are closed in background
+// (see closeLater).
+func (s *documentSet) get(id string, newDoc func() *Document) *openDocument {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.docs == nil {
+		s.docs = make(map[string]*openDocument)
+	}
+	for k, od := range s.docs {
+		if now.Sub(od.used) > s.ttl {
+			delete(s.docs, k)
+			s.closeLater(od)
+		}
+	}
+	od := s.docs[id]
+	if od == nil {
+		if len(s.docs) >= s.max {
+			var lru string
+			for k, od := range s.docs {
+				if lru == "" || od.used.Before(s.docs[lru].used) {
+					lru = k
+				}
+			}
+			s.closeLater(s.docs[lru])
+			delete(s.docs, lru)
+		}
+		od = &openDocument{doc: newDoc()}
+		s.docs[id] = od
+	}
+	od.used = now
+	return od
+}
+
+// closeLater closes the document in background. The document may wait for a pending request
+// to the native parser, thus it's not closed under the set mutex.
+func (s *documentSet) closeLater(od *openDocument) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		od.close()
+	}()
+}
+
+// reset forgets all documents without closing them, and waits for documents that are being closed.
+// It's used when native parsers are stopped, thus it must be called without the driver mutex.
+func (s *documentSet) reset() {
+	s.mu.Lock()
+	s.docs = nil
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// close discards the tree of the document in the native parser.
+func (od *openDocument) close() {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	od.closed = true
+	_ = od.doc.Close()
+}
+
+// diffText returns an edit that changes the old text to the new one.
+// It returns nil if the texts are the same.
+func diffText(old, src string) []Edit {
+	if old == src {
+		return nil
+	}
+	n := len(old)
+	if len(src) < n {
+		n = len(src)
+	}
+	start := 0
+	for start < n && old[start] == src[start] {
+		start++
+	}
+	// the edit must not start or end inside a character
+	for start > 0 && start < len(old) && !utf8.RuneStart(old[start]) {
+		start--
+	}
+	end := 0 // length of the common suffix
+	for end < n-start && old[len(old)-1-end] == src[len(src)-1-end] {
+		end++
+	}
+	for end > 0 && !utf8.RuneStart(old[len(old)-end]) {
+		end--
+	}
+	return []Edit{{Start: start, End: len(old) - end, Text: src[start : len(src)-end]}}
+}
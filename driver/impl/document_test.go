@@ -0,0 +1,440 @@
+package impl
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bblfsh/csharp-driver/driver/normalizer"
+	"github.com/bblfsh/sdk/v3/driver"
+	"github.com/bblfsh/sdk/v3/driver/manifest"
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	"github.com/bblfsh/sdk/v3/uast/transformer"
+	"github.com/bblfsh/sdk/v3/uast/uastyaml"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func TestApplyEdits(t *testing.T) {
+	cases := []struct {
+		name  string
+		src   string
+		edits []Edit
+		exp   string
+		exp16 []textEdit
+		err   bool
+	}{
+		{
+			name:  "insert",
+			src:   "class A {}",
+			edits: []Edit{{Start: 9, End: 9, Text: " int x; "}},
+			exp:   "class A { int x; }",
+			exp16: []textEdit{{Start: 9, End: 9, Text: " int x; "}},
+		},
+		{
+			name:  "multiple",
+			src:   "class A {}",
+			edits: []Edit{{Start: 0, End: 5, Text: "struct"}, {Start: 6, End: 7, Text: "B"}},
+			exp:   "struct B {}",
+			exp16: []textEdit{{Start: 0, End: 5, Text: "struct"}, {Start: 6, End: 7, Text: "B"}},
+		},
+		{
+			name:  "unicode",
+			src:   `s = "é𝄞"; t = 1;`,
+			edits: []Edit{{Start: 14, End: 15, Text: "u"}},
+			exp:   `s = "é𝄞"; u = 1;`,
+			exp16: []textEdit{{Start: 11, End: 12, Text: "u"}},
+		},
+		{
+			name:  "overlap",
+			src:   "class A {}",
+			edits: []Edit{{Start: 0, End: 5}, {Start: 3, End: 6}},
+			err:   true,
+		},
+		{
+			name:  "out of range",
+			src:   "class A {}",
+			edits: []Edit{{Start: 5, End: 20}},
+			err:   true,
+		},
+		{
+			name:  "inside a character",
+			src:   "é",
+			edits: []Edit{{Start: 1, End: 1, Text: "x"}},
+			err:   true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, edits, err := applyEdits(c.src, c.edits)
+			if c.err {
+				if err == nil {
+					t.Fatalf("expected an error, got: %q", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.exp {
+				t.Fatalf("unexpected text: %q", got)
+			}
+			if !reflect.DeepEqual(edits, c.exp16) {
+				t.Fatalf("unexpected edits: %+v", edits)
+			}
+		})
+	}
+}
+
+func TestUTF16Offsets(t *testing.T) {
+	// 'é' is 2 bytes in UTF-8 and one UTF-16 unit, '𝄞' is 4 bytes and a surrogate pair
+	src := "aé𝄞b"
+	got := utf16Offsets(src, []int{0, 1, 3, 3, 7, 8})
+	exp := []int{0, 1, 2, 2, 4, 5}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected offsets: %v", got)
+	}
+}
+
+// nativeMember returns a native member node with a given name and span.
+func nativeMember(name string, start, end int) nodes.Object {
+	return nodes.Object{
+		uast.KeyType: nodes.String("FieldDeclaration"),
+		"FullSpan":   textSpan(start, end),
+		"SpanStart":  nodes.Int(start),
+		"Name":       nodes.String(name),
+		"Token":      nodes.Object{uast.KeyType: nodes.String("None"), "SpanStart": nodes.Int(0)},
+	}
+}
+
+func TestShiftSpans(t *testing.T) {
+	got := shiftSpans(nativeMember("a", 3, 10), 5)
+	exp := nativeMember("a", 8, 15)
+	if !nodes.Equal(got, exp) {
+		t.Fatalf("unexpected node: %v", got)
+	}
+	// the original node is not modified
+	if start, _ := intValue(nativeMember("a", 3, 10)["SpanStart"]); start != 3 {
+		t.Fatalf("the node was modified")
+	}
+	// other fields named Start are not spans
+	n := nodes.Object{"Start": nodes.Int(1)}
+	if got := shiftSpans(n, 5); !nodes.Equal(got, n) {
+		t.Fatalf("unexpected node: %v", got)
+	}
+}
+
+func TestReuseNodes(t *testing.T) {
+	prev := nodes.Object{
+		uast.KeyType: nodes.String("CompilationUnit"),
+		"Members": nodes.Array{
+			nodes.Object{
+				uast.KeyType: nodes.String("ClassDeclaration"),
+				"FullSpan":   textSpan(0, 30),
+				"Members": nodes.Array{
+					nativeMember("a", 10, 20),
+					nativeMember("b", 20, 30),
+				},
+			},
+		},
+	}
+	reused := func(start, length, shift int) nodes.Object {
+		return nodes.Object{
+			uast.KeyType: nodes.String(typeReusedNode),
+			"Start":      nodes.Int(start),
+			"Length":     nodes.Int(length),
+			"Shift":      nodes.Int(shift),
+		}
+	}
+	// the first member is changed, the second one is moved
+	ast := nodes.Object{
+		uast.KeyType: nodes.String("CompilationUnit"),
+		"Members": nodes.Array{
+			nodes.Object{
+				uast.KeyType: nodes.String("ClassDeclaration"),
+				"FullSpan":   textSpan(0, 32),
+				"Members": nodes.Array{
+					nativeMember("c", 10, 22),
+					reused(20, 10, 2),
+				},
+			},
+		},
+	}
+	got, members, ok := reuseNodes(ast, prev)
+	if !ok {
+		t.Fatal("expected the member to be found")
+	}
+	exp := nodes.Object{
+		uast.KeyType: nodes.String("CompilationUnit"),
+		"Members": nodes.Array{
+			nodes.Object{
+				uast.KeyType: nodes.String("ClassDeclaration"),
+				"FullSpan":   textSpan(0, 32),
+				"Members": nodes.Array{
+					nativeMember("c", 10, 22),
+					nativeMember("b", 22, 32),
+				},
+			},
+		},
+	}
+	if !nodes.Equal(got, exp) {
+		t.Fatalf("unexpected AST: %v", got)
+	}
+	if exp := []reusedMember{{old: span{start: 20, end: 30}, shift: 2}}; !reflect.DeepEqual(members, exp) {
+		t.Fatalf("unexpected members: %+v", members)
+	}
+
+	// the whole class is reused
+	got, _, ok = reuseNodes(nodes.Object{
+		uast.KeyType: nodes.String("CompilationUnit"),
+		"Members":    nodes.Array{reused(0, 30, 1)},
+	}, prev)
+	if !ok {
+		t.Fatal("expected the member to be found")
+	}
+	if !nodes.Equal(got.(nodes.Object)["Members"], shiftSpans(prev["Members"], 1)) {
+		t.Fatalf("unexpected AST: %v", got)
+	}
+
+	// the member is not in the previous AST
+	if _, _, ok = reuseNodes(nodes.Object{
+		uast.KeyType: nodes.String("CompilationUnit"),
+		"Members":    nodes.Array{reused(5, 10, 0)},
+	}, prev); ok {
+		t.Fatal("expected the member to be missing")
+	}
+}
+
+func TestDiffText(t *testing.T) {
+	cases := []struct {
+		old, src string
+		exp      []Edit
+	}{
+		{old: "class A {}", src: "class A {}"},
+		{old: "", src: "class A {}", exp: []Edit{{Start: 0, End: 0, Text: "class A {}"}}},
+		{old: "class A {}", src: "class B {}", exp: []Edit{{Start: 6, End: 7, Text: "B"}}},
+		{old: "class A {}", src: "class A { }", exp: []Edit{{Start: 9, End: 9, Text: " "}}},
+		{old: "aaa", src: "aa", exp: []Edit{{Start: 2, End: 3, Text: ""}}},
+		// 'é' and 'è' share the first byte, the edit must include it
+		{old: `s = "é";`, src: `s = "è";`, exp: []Edit{{Start: 5, End: 7, Text: "è"}}},
+		// 'é' and '©' share the last byte
+		{old: `"é"`, src: `"©"`, exp: []Edit{{Start: 1, End: 3, Text: "©"}}},
+	}
+	for _, c := range cases {
+		got := diffText(c.old, c.src)
+		if !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("%q -> %q: unexpected edits: %+v", c.old, c.src, got)
+			continue
+		}
+		if out, _, err := applyEdits(c.old, got); err != nil {
+			t.Errorf("%q -> %q: %v", c.old, c.src, err)
+		} else if out != c.src {
+			t.Errorf("%q -> %q: unexpected text: %q", c.old, c.src, out)
+		}
+	}
+}
+
+func TestMoveMembers(t *testing.T) {
+	a, b, c := &uastMember{}, &uastMember{}, &uastMember{}
+	members := map[span]*uastMember{
+		{start: 0, end: 10}:  a,
+		{start: 15, end: 20}: b, // nested into a reused class
+		{start: 30, end: 40}: c, // changed
+	}
+	got := moveMembers(members, []reusedMember{
+		{old: span{start: 10, end: 25}, shift: 3},
+		{old: span{start: 0, end: 10}, shift: 0},
+	})
+	exp := map[span]*uastMember{
+		{start: 0, end: 10}:  a,
+		{start: 18, end: 23}: b,
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected members: %v", got)
+	}
+}
+
+func TestDocumentUnknown(t *testing.T) {
+	d, closer := newFakeDriver(t)
+	defer closer()
+
+	ctx := context.Background()
+	doc := d.NewDocument()
+	if _, err := doc.Parse(ctx, "class A {}"); err != nil {
+		t.Fatal(err)
+	}
+	// the fake parser doesn't know any documents, the text must be parsed from scratch
+	if _, err := doc.Edit(ctx, Edit{Start: 6, End: 7, Text: "B"}); err != nil {
+		t.Fatal(err)
+	}
+	if src := doc.Source(); src != "class B {}" {
+		t.Fatalf("unexpected text: %q", src)
+	}
+	if err := doc.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDocumentSet(t *testing.T) {
+	d, closer := newFakeDriver(t)
+	defer closer()
+	d.docs.max = 2
+
+	parse := func(id, src string) {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(metadataDocument, id))
+		if _, err := d.Parse(ctx, src); err != nil {
+			t.Fatal(err)
+		}
+	}
+	parse("1", "class A {}")
+	od := d.docs.docs["1"]
+	parse("1", "class B {}")
+	if d.docs.docs["1"] != od {
+		t.Fatal("expected the document to be reused")
+	} else if src := od.doc.Source(); src != "class B {}" {
+		t.Fatalf("unexpected text: %q", src)
+	}
+	parse("2", "class A {}")
+	parse("3", "class A {}")
+	if _, ok := d.docs.docs["1"]; ok || len(d.docs.docs) != 2 {
+		t.Fatalf("expected the least recently used document to be closed: %v", d.docs.docs)
+	}
+	waitClosed := func(od *openDocument) {
+		deadline := time.Now().Add(time.Second)
+		for {
+			od.mu.Lock()
+			closed := od.closed
+			od.mu.Unlock()
+			if closed {
+				return
+			} else if time.Now().After(deadline) {
+				t.Fatal("the document is not closed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitClosed(od)
+
+	d.docs.ttl = 50 * time.Millisecond
+	od = d.docs.docs["2"]
+	time.Sleep(100 * time.Millisecond)
+	parse("3", "class B {}")
+	if _, ok := d.docs.docs["2"]; ok || len(d.docs.docs) != 1 {
+		t.Fatalf("expected the expired document to be closed: %v", d.docs.docs)
+	}
+	waitClosed(od)
+}
+
+func TestDocumentID(t *testing.T) {
+	ctx := context.Background()
+	if id := documentID(ctx); id != "" {
+		t.Fatalf("unexpected id: %q", id)
+	}
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(metadataDocument, "1"))
+	if id := documentID(ctx); id != "1" {
+		t.Fatalf("unexpected id: %q", id)
+	}
+	// the same id sent by different clients refers to different documents
+	client := func(port int) string {
+		return documentID(peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}}))
+	}
+	if a, b := client(1), client(2); a == b || a != client(1) {
+		t.Fatalf("unexpected ids: %q, %q", a, b)
+	}
+}
+
+// transformFunc is a transformation implemented by a function.
+type transformFunc func(n nodes.Node) (nodes.Node, error)
+
+func (f transformFunc) Do(n nodes.Node) (nodes.Node, error) {
+	return f(n)
+}
+
+func TestDocumentServer(t *testing.T) {
+	d, closer := newFakeDriver(t)
+	defer closer()
+	var seen []nodes.Node
+	dm, err := driver.NewDriverFrom(d, &manifest.Manifest{}, driver.Transforms{
+		Preprocess: []transformer.Transformer{transformFunc(func(n nodes.Node) (nodes.Node, error) {
+			seen = append(seen, n)
+			return n, nil
+		})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(metadataDocument, "1"))
+	for _, src := range []string{"file1", "file2"} {
+		if _, err := dm.Parse(ctx, src, &driver.ParseOptions{Mode: driver.ModeSemantic}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(d.docs.docs) != 1 {
+		t.Fatalf("expected a single open document: %v", d.docs.docs)
+	}
+	// the parsing is incremental, but the server transforms the whole native AST of each request
+	if len(seen) != 2 {
+		t.Fatalf("expected 2 transformations, got %d", len(seen))
+	}
+	if obj, _ := seen[1].(nodes.Object); obj["content"] != nodes.String("file2") {
+		t.Fatalf("unexpected AST: %v", seen[1])
+	}
+}
+
+func TestDocumentTransform(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"u2_class_field.cs", "doc_comments.cs", "generics.cs", "Program.cs"} {
+		t.Run(name, func(t *testing.T) {
+			data, err := ioutil.ReadFile("../../fixtures/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			src := string(data)
+			data, err = ioutil.ReadFile("../../fixtures/" + name + ".native")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ast, err := uastyaml.Unmarshal(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc := &Document{src: src, last: ast}
+			check := func() {
+				exp, err := normalizer.Transforms.Do(ctx, driver.ModeSemantic, doc.src, doc.last)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := doc.Transform(ctx, normalizer.Transforms, driver.ModeSemantic)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !nodes.Equal(exp, got) {
+					t.Fatal("the AST is different from the one transformed as a whole")
+				}
+			}
+			check()
+			if len(doc.members) == 0 {
+				t.Fatal("expected members to be transformed separately")
+			}
+			members := doc.members
+			check()
+			for s, m := range doc.members {
+				if members[s] != m {
+					t.Fatal("expected members to be reused")
+				}
+			}
+
+			// insert a line at the start of the file, as if the native parser reused all members
+			var reused []reusedMember
+			for s := range memberNodes(ast) {
+				reused = append(reused, reusedMember{old: s, shift: 1})
+			}
+			doc.members = moveMembers(doc.members, reused)
+			doc.src, doc.last = "\n"+src, shiftSpans(ast, 1)
+			check()
+		})
+	}
+}
@@ -1,11 +1,23 @@
 package impl
 
 import (
-	"github.com/bblfsh/sdk/v3/driver/native"
+	"os"
+
+	"github.com/bblfsh/csharp-driver/driver/normalizer"
 	"github.com/bblfsh/sdk/v3/driver/server"
 )
 
+// cache is the cache of parse results configured with environment variables. It's nil, if the cache
+// is disabled (see NewCacheFromEnv).
+var cache = NewCacheFromEnv()
+
 func init() {
 	// Can be overridden to link a native driver into a Go driver server.
-	server.DefaultDriver = native.NewDriver(native.UTF8)
+	server.DefaultDriver = NewPool(0)
+	if cache != nil {
+		server.DefaultDriver = cache.Native(server.DefaultDriver)
+	}
+	if addr := os.Getenv(envBatchAddress); addr != "" {
+		server.DefaultDriver = &batchListener{Native: server.DefaultDriver, addr: addr, t: normalizer.Transforms}
+	}
 }
@@ -0,0 +1,521 @@
+package impl
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bblfsh/sdk/v3/driver"
+	derrors "github.com/bblfsh/sdk/v3/driver/errors"
+	"github.com/bblfsh/sdk/v3/driver/native"
+	"github.com/bblfsh/sdk/v3/driver/native/jsonlines"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	serrors "gopkg.in/src-d/go-errors.v1"
+)
+
+const (
+	closeTimeout = time.Second * 5
+
+	// minReadLimit is the minimal limit of the response size checked by the driver. Responses
+	// with errors must always fit into the limit, even if the size limit of the AST is lower.
+	minReadLimit = 4096
+)
+
+var (
+	// ErrTimeout is returned when the native parser doesn't respond before the deadline.
+	ErrTimeout = serrors.NewKind("native parser timed out")
+	// ErrTooLarge is returned when the native AST exceeds the size limit.
+	ErrTooLarge = serrors.NewKind("native AST is larger than %d bytes")
+
+	// errUnknownDocument is returned when the native parser doesn't have the tree of the document.
+	errUnknownDocument = errors.New("unknown document")
+)
+
+var _ driver.Native = (*Driver)(nil)
+
+// Driver is a wrapper of the native C# parser.
+//
+// It works the same way as the native driver from the SDK, but allows to pass additional
+// parse options to the native parser (see WithParseOptions). If the native parser dies,
+// it is restarted transparently on the next request.
+type Driver struct {
+	// Format is a wire format used by the native parser to send responses.
+	// It must be set before calling Start. See WireFormat.
+	Format WireFormat
+	// Schema is a schema of native ASTs. It must be set before calling Start. See Schema.
+	Schema Schema
+
+	bin     string
+	started bool
+	docs    *documentSet
+
+	mu     sync.Mutex
+	enc    jsonlines.Encoder
+	dec    jsonlines.Decoder
+	lines  *lineReader
+	stdin  *os.File
+	stdout *os.File
+	cmd    *exec.Cmd
+	cmdErr chan error
+	broken bool
+	gen    int // incremented each time the native parser is started
+}
+
+// NewDriver creates a new C# driver that will run the native parser from the default location.
+func NewDriver() *Driver {
+	return NewDriverAt("")
+}
+
+// NewDriverAt is like NewDriver, but allows to specify a path to the native parser binary.
+func NewDriverAt(bin string) *Driver {
+	if bin == "" {
+		bin = native.Binary
+	}
+	return &Driver{
+		bin: bin, docs: newDocumentSet(),
+		Format: WireFormat(os.Getenv(envWireFormat)), Schema: schemaFromEnv(),
+	}
+}
+
+// Start executes the native parser and prepares it to parse code.
+func (d *Driver) Start() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.start()
+}
+
+// start executes the native parser. It must be called with the mutex held.
+func (d *Driver) start() error {
+	d.broken = false
+	d.gen++
+	d.cmd = exec.Command(d.bin)
+	d.cmd.Stderr = os.Stderr
+
+	stdin, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	r, stdout, err := os.Pipe()
+	if err != nil {
+		stdin.Close()
+		w.Close()
+		return err
+	}
+	d.stdin, d.stdout = w, r
+	d.cmd.Stdin = stdin
+	d.cmd.Stdout = stdout
+
+	d.enc = jsonlines.NewEncoder(d.stdin)
+	d.lines = &lineReader{r: bufio.NewReaderSize(d.stdout, jsonlines.DefaultBufferSize)}
+	d.dec = jsonlines.NewDecoder(d.lines)
+
+	if err := d.cmd.Start(); err != nil {
+		d.stdin.Close()
+		d.stdout.Close()
+		stdin.Close()
+		stdout.Close()
+		return err
+	}
+	d.started = true
+	errc := make(chan error, 1)
+	d.cmdErr = errc
+	go func() {
+		// close pipes when the parser exits
+		defer func() {
+			stdin.Close()
+			stdout.Close()
+			close(errc)
+		}()
+		errc <- d.cmd.Wait()
+	}()
+	if (d.Format != "" && d.Format != WireJSON) || (d.Schema != "" && d.Schema != SchemaFull) {
+		if err := d.negotiate(d.Format, d.Schema); err != nil {
+			d.started = false
+			d.cmd.Process.Kill()
+			_ = d.close()
+			return err
+		}
+	}
+	return nil
+}
+
+// parseRequest is a request to the native parser.
+type parseRequest struct {
+	Content         string   `json:"content"`
+	Symbols         []string `json:"symbols,omitempty"`
+	LanguageVersion string   `json:"languageVersion,omitempty"`
+
+	// Document is an id of the document that is parsed incrementally (see Document).
+	Document string     `json:"document,omitempty"`
+	Edits    []textEdit `json:"edits,omitempty"`
+	Close    bool       `json:"close,omitempty"`
+
+	// Files is a list of files in the batch request (see Driver.ParseBatch).
+	Files []batchFile `json:"files,omitempty"`
+
+	// MaxSize is the size limit of each response. The native parser drops responses that exceed
+	// it, thus they are not sent over the pipe.
+	MaxSize int `json:"maxSize,omitempty"`
+}
+
+var _ json.Unmarshaler = (*parseResponse)(nil)
+
+// parseResponse is a response of the native parser.
+type parseResponse struct {
+	Status          string
+	Errors          []string
+	AST             nodes.Node
+	LanguageVersion string
+	Diagnostics     []nativeDiagnostic
+	Format          WireFormat
+	Schema          Schema
+	Defaults        nodes.Object
+}
+
+func (r *parseResponse) UnmarshalJSON(data []byte) error {
+	var resp struct {
+		Status          string             `json:"status"`
+		Errors          []string           `json:"errors"`
+		AST             interface{}        `json:"ast"`
+		LanguageVersion string             `json:"languageVersion"`
+		Diagnostics     []nativeDiagnostic `json:"diagnostics"`
+		Format          WireFormat         `json:"format"`
+		Schema          Schema             `json:"schema"`
+		Defaults        interface{}        `json:"defaults"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	ast, err := nodes.ToNode(resp.AST, nil)
+	if err != nil {
+		return err
+	}
+	defaults, err := nodes.ToNode(resp.Defaults, nil)
+	if err != nil {
+		return err
+	}
+	*r = parseResponse{
+		Status:          strings.ToLower(resp.Status),
+		Errors:          resp.Errors,
+		AST:             ast,
+		LanguageVersion: resp.LanguageVersion,
+		Diagnostics:     resp.Diagnostics,
+		Format:          resp.Format,
+		Schema:          resp.Schema,
+	}
+	r.Defaults, _ = defaults.(nodes.Object)
+	return nil
+}
+
+// Parse sends a request to the native parser and returns its response.
+//
+// Preprocessor symbols are taken from the context (see WithParseOptions). If multiple symbol
+// sets are specified, the file is parsed once per set and the results are merged (see mergeVariants).
+//
+// If the language version is specified, the effective language version is reported in the
+// LanguageVersion field of the root node.
+//
+// The timeout and the size limit from parse options apply to all symbol sets together.
+// If the file cannot be parsed with one of the additional symbol sets, the merged AST is still
+// returned, and the error is reported in the corresponding variant.
+//
+// If gRPC metadata of the request has a document id, the file is parsed incrementally, using
+// the previous text of the document with the same id (see documentSet). The whole native AST is
+// still returned, thus the server of the SDK transforms all of it (see Document.Transform).
+func (d *Driver) Parse(ctx context.Context, src string) (nodes.Node, error) {
+	if id := documentID(ctx); id != "" {
+		return d.docs.parse(ctx, id, src, d.NewDocument)
+	}
+	opts := parseOptionsFrom(ctx)
+	sets := opts.symbolSets()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.started {
+		return nil, driver.ErrDriverFailure.Wrap(native.ErrNotRunning.New())
+	}
+
+	if opts.Timeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	var version string
+	roots := make([]nodes.Node, 0, len(sets))
+	errs := make([]error, 0, len(sets))
+	for i, set := range sets {
+		ast, vers, err := d.parse(ctx, &parseRequest{
+			Content: src, Symbols: set, LanguageVersion: opts.LanguageVersion,
+		}, opts.MaxSize)
+		if err != nil && i == 0 {
+			return withLanguageVersion(ast, opts, vers), err
+		}
+		// failures of other symbol sets are reported in the variant (see mergeVariants)
+		roots = append(roots, ast)
+		errs = append(errs, err)
+		if i == 0 {
+			version = vers
+		}
+	}
+	ast := roots[0]
+	if len(roots) > 1 {
+		ast = mergeVariants(roots, sets, errs)
+	}
+	return withLanguageVersion(ast, opts, version), nil
+}
+
+// check sends an empty request to the native parser to make sure it responds in time.
+// The parser is restarted, if the check fails.
+func (d *Driver) check(timeout time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.started {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, _, err := d.parse(ctx, &parseRequest{}, 0)
+	if d.broken {
+		// restart it now instead of delaying the next request
+		if rerr := d.restart(); rerr != nil {
+			return rerr
+		}
+	}
+	return err
+}
+
+// withLanguageVersion reports the effective language version in the root node, if the version was
+// set in parse options. Native ASTs parsed with the default version are not changed.
+func withLanguageVersion(ast nodes.Node, opts ParseOptions, version string) nodes.Node {
+	root, ok := ast.(nodes.Object)
+	if !ok || opts.LanguageVersion == "" || version == "" {
+		return ast
+	}
+	root = root.CloneObject()
+	root["LanguageVersion"] = nodes.String(version)
+	return root
+}
+
+// parse sends a single request to the native parser. It returns the AST and the effective
+// language version. The size of the response is limited to maxSize bytes, if it's not zero.
+// It must be called with the mutex held.
+func (d *Driver) parse(ctx context.Context, req *parseRequest, maxSize int) (nodes.Node, string, error) {
+	if err := d.revive(); err != nil {
+		return nil, "", err
+	}
+	d.setDeadline(ctx)
+	defer d.resetDeadline()
+
+	req.MaxSize = maxSize
+	if err := d.send(ctx, req); err != nil {
+		return nil, "", err
+	}
+	return d.receive(ctx, maxSize)
+}
+
+// send writes a request to the native parser. If the parser died before reading the request,
+// it is restarted and the request is sent once more. It must be called with the mutex held.
+func (d *Driver) send(ctx context.Context, req *parseRequest) error {
+	err := d.enc.Encode(req)
+	if err != nil && d.exited() {
+		// the parser died before reading the request, restart it and try once more
+		if err := d.restart(); err != nil {
+			return err
+		}
+		d.setDeadline(ctx)
+		err = d.enc.Encode(req)
+	}
+	if err != nil {
+		d.kill()
+		return driver.ErrDriverFailure.Wrap(timeoutErr(ctx, err))
+	}
+	return nil
+}
+
+// receive reads a single response of the native parser. It returns the AST and the effective
+// language version. It must be called with the mutex held.
+func (d *Driver) receive(ctx context.Context, maxSize int) (nodes.Node, string, error) {
+	var r parseResponse
+	// the limit is enforced by the native parser; the driver only makes sure it won't read
+	// a response that is way too large, in case the parser ignores the limit
+	d.lines.max = maxSize
+	if maxSize > 0 && maxSize < minReadLimit {
+		d.lines.max = minReadLimit
+	}
+	err := d.dec.Decode(&r)
+	if err == io.EOF {
+		if err := d.restart(); err != nil {
+			return nil, "", err
+		}
+		// fail anyway - this request may have caused the crash
+		return nil, "", driver.ErrDriverFailure.Wrap(native.ErrDriverCrashed.New())
+	} else if err != nil {
+		// we can't be sure what happened (a timeout, a response that is too large
+		// or a broken stream), so let's not mess with the client and stop the parser now
+		d.kill()
+		return nil, "", driver.ErrDriverFailure.Wrap(timeoutErr(ctx, err))
+	}
+	r.AST = withSchemaDefaults(r.AST, r.Defaults)
+	recordNativeSize(ctx, d.lines.last)
+	if r.Status == "ok" {
+		// syntax errors don't fail the request, see Diagnostic
+		return withDiagnostics(r.AST, r.Diagnostics), r.LanguageVersion, nil
+	}
+	errs := make([]error, 0, len(r.Errors))
+	for _, s := range r.Errors {
+		errs = append(errs, errors.New(s))
+	}
+	err = derrors.Join(errs)
+	switch r.Status {
+	case "error":
+		// wrapping will be done on a higher level
+		return r.AST, r.LanguageVersion, err
+	case "fatal":
+		return nil, "", driver.ErrDriverFailure.Wrap(err)
+	case "toolarge":
+		// the parser has dropped the response, thus it doesn't need to be restarted
+		return nil, "", driver.ErrDriverFailure.Wrap(ErrTooLarge.New(maxSize))
+	case "unknowndocument":
+		// the parser has closed the document, it will be parsed from scratch (see Document)
+		return nil, "", errUnknownDocument
+	}
+	return nil, "", fmt.Errorf("unsupported status: %v", r.Status)
+}
+
+// timeoutErr returns ErrTimeout if the error was caused by the deadline of the request.
+// Other errors are returned as-is.
+func timeoutErr(ctx context.Context, err error) error {
+	if os.IsTimeout(err) || ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout.Wrap(err)
+	}
+	return err
+}
+
+// lineReader reads lines of the native parser output with an optional limit of the line size.
+//
+// It allows to stop reading a response that is too large before it's fully loaded into memory.
+type lineReader struct {
+	r    *bufio.Reader
+	max  int // no limit, if zero
+	last int // size of the last response, without the delimiter
+}
+
+func (r *lineReader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+// ReadBytes implements a line reader interface used by jsonlines.Decoder.
+func (r *lineReader) ReadBytes(delim byte) ([]byte, error) {
+	var line []byte
+	for {
+		buf, err := r.r.ReadSlice(delim)
+		if r.max > 0 && len(line)+len(buf) > r.max {
+			return nil, ErrTooLarge.New(r.max)
+		}
+		line = append(line, buf...)
+		if err != bufio.ErrBufferFull {
+			r.last = len(line)
+			if err == nil {
+				r.last--
+			}
+			return line, err
+		}
+	}
+}
+
+// setDeadline sets the read and write deadline for the parser pipes, if the context has one.
+func (d *Driver) setDeadline(ctx context.Context) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = d.stdout.SetReadDeadline(deadline)
+		_ = d.stdin.SetWriteDeadline(deadline)
+	}
+}
+
+// resetDeadline removes the read and write deadline from the parser pipes.
+func (d *Driver) resetDeadline() {
+	_ = d.stdin.SetWriteDeadline(time.Time{})
+	_ = d.stdout.SetReadDeadline(time.Time{})
+}
+
+// revive restarts the native parser if the protocol is broken and we decided to shutdown
+// the parser, or if the parser died between requests.
+func (d *Driver) revive() error {
+	if d.broken || d.exited() {
+		return d.restart()
+	}
+	return nil
+}
+
+// exited checks if the native parser process has exited. The exit code is ignored.
+func (d *Driver) exited() bool {
+	select {
+	case <-d.cmdErr:
+		return true
+	default:
+		return false
+	}
+}
+
+// kill stops the native parser and marks it as broken. It will be restarted on the next request.
+func (d *Driver) kill() {
+	d.broken = true
+	d.cmd.Process.Kill()
+	_ = d.close()
+}
+
+func (d *Driver) restart() error {
+	// parser died; we don't care about exit code
+	<-d.cmdErr
+	d.stdin.Close()
+	d.stdout.Close()
+	if err := d.start(); err != nil {
+		d.broken = true
+		return driver.ErrDriverFailure.Wrap(err, "driver restart failed")
+	}
+	return nil
+}
+
+// close stops the execution of the native parser. It must be called with the mutex held.
+func (d *Driver) close() error {
+	last := d.stdin.Close()
+	if er, ok := last.(*os.PathError); ok && er.Err == os.ErrClosed {
+		last = nil
+	}
+	timeout := time.NewTimer(closeTimeout)
+	select {
+	case <-d.cmdErr: // don't care about exit code
+		timeout.Stop()
+	case <-timeout.C:
+		d.cmd.Process.Kill()
+	}
+	err := d.stdout.Close()
+	if er, ok := err.(*os.PathError); ok && er.Err == os.ErrClosed {
+		err = nil
+	}
+	if last != nil {
+		return last
+	}
+	return err
+}
+
+// Close stops the execution of the native parser. It waits for pending requests to finish.
+func (d *Driver) Close() error {
+	// documents are closed without the mutex, since they send requests to the parser
+	d.docs.reset()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.started {
+		return nil
+	}
+	d.started = false
+	return d.close()
+}
@@ -0,0 +1,282 @@
+package impl
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bblfsh/sdk/v3/driver"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	"google.golang.org/grpc/metadata"
+)
+
+// fakeParser is a script that mimics the native parser. The response depends on the content
+// of the request:
+//
+//   - "slow" never responds;
+//   - "large" responds with an AST larger than 8 KB, ignoring the size limit;
+//   - "huge" responds as if the native parser dropped an AST that exceeds the size limit;
+//   - "delay" responds with a small AST after a short delay;
+//   - "crash" exits without responding;
+//   - "fatal" responds as if the native parser failed with an exception;
+//   - "file..." responds with an AST that has the content in the "content" field;
+//   - requests with a language version get it back as the effective version, unless it's "invalid";
+//   - incremental requests get a response as if the parser has closed the document.
+//
+// All other requests get a small AST in response. Batch requests get a response for each file,
+// the same as for a request with the content of the file.
+var fakeParser = `#!/bin/sh
+respond() {
+	case "$1" in
+	*'"content":"slow"'*) exec sleep 5 ;;
+	*'"content":"large"'*) echo '{"status":"ok","ast":{"@type":"CompilationUnit","Text":"` + strings.Repeat("x", 8192) + `"}}' ;;
+	*'"content":"huge"'*) echo '{"status":"tooLarge","errors":["native AST is too large"]}' ;;
+	*'"content":"delay"'*) sleep 0.2; echo '{"status":"ok","ast":{"@type":"CompilationUnit"}}' ;;
+	*'"content":"crash"'*) exit 1 ;;
+	*'"content":"fatal"'*) echo '{"status":"fatal","errors":["exception"]}' ;;
+	*'"edits":'*) echo '{"status":"unknownDocument"}' ;;
+	*'"languageVersion":"invalid"'*) echo '{"status":"fatal","errors":["unsupported language version: invalid"]}' ;;
+	*'"languageVersion":'*) echo "{\"status\":\"ok\",\"ast\":{\"@type\":\"CompilationUnit\"},$(echo "$1" | grep -o '"languageVersion":"[^"]*"')}" ;;
+	*'"content":"file'*) echo "{\"status\":\"ok\",\"ast\":{\"@type\":\"CompilationUnit\",$(echo "$1" | grep -o '"content":"[^"]*"')}}" ;;
+	*) echo '{"status":"ok","ast":{"@type":"CompilationUnit"}}' ;;
+	esac
+}
+while read -r line; do
+	case "$line" in
+	*'"files":'*) for f in $(echo "${line#*'"files":'}" | grep -o '"content":"[^"]*"'); do respond "$f"; done ;;
+	*) respond "$line" ;;
+	esac
+done
+`
+
+// writeFakeParser writes the fake native parser to a temporary directory. It returns the path
+// to the binary and a function that removes it.
+func writeFakeParser(t testing.TB) (string, func()) {
+	dir, err := ioutil.TempDir("", "csharp-driver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "native")
+	if err = ioutil.WriteFile(bin, []byte(fakeParser), 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return bin, func() { os.RemoveAll(dir) }
+}
+
+// newFakeDriver starts a driver with the fake native parser.
+func newFakeDriver(t testing.TB) (*Driver, func()) {
+	bin, remove := writeFakeParser(t)
+	d := NewDriverAt(bin)
+	d.Format, d.Schema = WireJSON, SchemaFull
+	if err := d.Start(); err != nil {
+		remove()
+		t.Fatal(err)
+	}
+	return d, func() {
+		d.Close()
+		remove()
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	d, closer := newFakeDriver(t)
+	defer closer()
+
+	ctx := WithParseOptions(context.Background(), ParseOptions{Timeout: 100 * time.Millisecond})
+	cmd := d.cmd
+	_, err := d.Parse(ctx, "slow")
+	if !ErrTimeout.Is(err) || !driver.ErrDriverFailure.Is(err) {
+		t.Fatalf("expected a timeout, got: %v", err)
+	}
+	// the parser is restarted, the next request must succeed
+	if _, err = d.Parse(ctx, "ok"); err != nil {
+		t.Fatal(err)
+	}
+	if d.cmd == cmd {
+		t.Fatal("expected the parser to be restarted")
+	}
+}
+
+func TestParseTooLarge(t *testing.T) {
+	d, closer := newFakeDriver(t)
+	defer closer()
+
+	ctx := WithParseOptions(context.Background(), ParseOptions{MaxSize: 64})
+	cmd := d.cmd
+
+	// the native parser drops the AST, thus it doesn't need to be restarted
+	_, err := d.Parse(ctx, "huge")
+	if !ErrTooLarge.Is(err) || !driver.ErrDriverFailure.Is(err) {
+		t.Fatalf("expected a size limit error, got: %v", err)
+	}
+	if d.cmd != cmd || d.broken {
+		t.Fatal("the parser must not be restarted")
+	}
+	if _, err = d.Parse(ctx, "ok"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the driver checks the size of the response as well
+	_, err = d.Parse(ctx, "large")
+	if !ErrTooLarge.Is(err) || !driver.ErrDriverFailure.Is(err) {
+		t.Fatalf("expected a size limit error, got: %v", err)
+	}
+	if _, err = d.Parse(ctx, "ok"); err != nil {
+		t.Fatal(err)
+	}
+	if d.cmd == cmd {
+		t.Fatal("expected the parser to be restarted")
+	}
+
+	// the limit is not applied without the option
+	if _, err = d.Parse(context.Background(), "large"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseLanguageVersion(t *testing.T) {
+	d, closer := newFakeDriver(t)
+	defer closer()
+	defer setEnv(map[string]string{envLanguageVersion: ""})()
+
+	version := func(ctx context.Context) nodes.Node {
+		ast, err := d.Parse(ctx, "ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ast.(nodes.Object)["LanguageVersion"]
+	}
+	ctx := context.Background()
+	if v := version(ctx); v != nil {
+		t.Fatalf("unexpected language version: %v", v)
+	}
+	os.Setenv(envLanguageVersion, "7.3")
+	if v := version(ctx); v != nodes.String("7.3") {
+		t.Fatalf("unexpected language version: %v", v)
+	}
+	// metadata overrides the environment, and the context overrides both
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("csharp-lang-version", "8.0"))
+	if v := version(ctx); v != nodes.String("8.0") {
+		t.Fatalf("unexpected language version: %v", v)
+	}
+	if v := version(WithParseOptions(ctx, ParseOptions{LanguageVersion: "latest"})); v != nodes.String("latest") {
+		t.Fatalf("unexpected language version: %v", v)
+	}
+
+	_, err := d.Parse(WithParseOptions(ctx, ParseOptions{LanguageVersion: "invalid"}), "ok")
+	if !driver.ErrDriverFailure.Is(err) || !strings.Contains(err.Error(), "unsupported language version") {
+		t.Fatalf("expected an unsupported language version, got: %v", err)
+	}
+}
+
+func TestParseFatal(t *testing.T) {
+	d, closer := newFakeDriver(t)
+	defer closer()
+	ctx := context.Background()
+	cmd := d.cmd
+
+	// the native parser survives exceptions, thus it doesn't need to be restarted
+	_, err := d.Parse(ctx, "fatal")
+	if !driver.ErrDriverFailure.Is(err) || !strings.Contains(err.Error(), "exception") {
+		t.Fatalf("expected a fatal error, got: %v", err)
+	}
+	if _, err = d.Parse(ctx, "ok"); err != nil {
+		t.Fatal(err)
+	}
+	if d.cmd != cmd || d.broken {
+		t.Fatal("the parser must not be restarted")
+	}
+}
+
+func TestParseKilled(t *testing.T) {
+	d, closer := newFakeDriver(t)
+	defer closer()
+	cmd := d.cmd
+
+	d.mu.Lock()
+	if err := d.cmd.Process.Kill(); err != nil {
+		d.mu.Unlock()
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); !d.exited(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			d.mu.Unlock()
+			t.Fatal("the parser is not stopped")
+		}
+	}
+	d.mu.Unlock()
+
+	// the dead parser is restarted transparently, the next request must succeed
+	if _, err := d.Parse(context.Background(), "ok"); err != nil {
+		t.Fatal(err)
+	}
+	if d.cmd == cmd {
+		t.Fatal("expected the parser to be restarted")
+	}
+}
+
+// TestNativeMalformedRequest checks that the native parser responds to a request it can't read,
+// instead of exiting or waiting for more input.
+func TestNativeMalformedRequest(t *testing.T) {
+	bin := "../../build/bin/native"
+	if _, err := os.Stat(bin); err != nil {
+		t.Skip("native parser is not built")
+	}
+	cmd := exec.Command(bin)
+	cmd.Stdin = strings.NewReader("{\"content\":\n" + `{"content":"class A {}"}` + "\n")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	type response struct {
+		Status string   `json:"status"`
+		Errors []string `json:"errors"`
+	}
+	resps := make(chan response)
+	go func() {
+		defer close(resps)
+		r := bufio.NewReaderSize(stdout, 1<<20)
+		for {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			var resp response
+			_ = json.Unmarshal(line, &resp)
+			resps <- resp
+		}
+	}()
+	next := func() response {
+		select {
+		case resp, ok := <-resps:
+			if !ok {
+				t.Fatal("the parser exited without responding")
+			}
+			return resp
+		case <-time.After(30 * time.Second):
+			t.Fatal("the parser doesn't respond")
+		}
+		return response{}
+	}
+	if resp := next(); resp.Status != "fatal" || len(resp.Errors) == 0 {
+		t.Fatalf("expected a fatal response, got: %+v", resp)
+	}
+	// the next request succeeds
+	if resp := next(); resp.Status != "ok" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+}
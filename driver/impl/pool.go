@@ -0,0 +1,219 @@
+package impl
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bblfsh/sdk/v3/driver"
+	"github.com/bblfsh/sdk/v3/driver/native"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+)
+
+const (
+	// envWorkers is the name of an environment variable with the default number of native
+	// parser processes in the pool.
+	envWorkers = "CSHARP_DRIVER_WORKERS"
+
+	// healthInterval is an interval between health checks of idle native parsers.
+	healthInterval = time.Second * 30
+	// healthTimeout is the time a native parser has to respond to a health check.
+	healthTimeout = time.Second * 10
+)
+
+var _ driver.Native = (*Pool)(nil)
+
+// Pool is a pool of native C# parsers that allows to parse multiple files concurrently.
+//
+// Each request is sent to the least loaded parser; parsers with the same load are chosen
+// in a round-robin order. Idle parsers are checked periodically and are restarted if they
+// don't respond. Parse options are handled the same way as in Driver.
+type Pool struct {
+	// Format is a wire format used by native parsers to send responses.
+	// It must be set before calling Start. See WireFormat.
+	Format WireFormat
+	// Schema is a schema of native ASTs. It must be set before calling Start. See Schema.
+	Schema Schema
+
+	bin  string
+	size int
+	docs *documentSet
+
+	mu      sync.Mutex
+	workers []*worker
+	next    int // the first worker to check on the next request
+	running bool
+
+	reqs sync.WaitGroup // pending requests
+	stop chan struct{}
+	done chan struct{}
+}
+
+// worker is a single native parser in the pool.
+type worker struct {
+	*Driver
+	load int // number of pending requests; protected by the pool mutex
+}
+
+// NewPool creates a pool of C# parsers that will run the native parser from the default location.
+//
+// If size is zero or negative, the size is taken from the environment (CSHARP_DRIVER_WORKERS),
+// and defaults to a single parser.
+func NewPool(size int) *Pool {
+	return NewPoolAt("", size)
+}
+
+// NewPoolAt is like NewPool, but allows to specify a path to the native parser binary.
+func NewPoolAt(bin string, size int) *Pool {
+	if size <= 0 {
+		size, _ = strconv.Atoi(os.Getenv(envWorkers))
+	}
+	if size <= 0 {
+		size = 1
+	}
+	return &Pool{
+		bin: bin, size: size, docs: newDocumentSet(),
+		Format: WireFormat(os.Getenv(envWireFormat)), Schema: schemaFromEnv(),
+	}
+}
+
+// Start executes all native parsers in the pool.
+func (p *Pool) Start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running {
+		return nil
+	}
+	workers := make([]*worker, 0, p.size)
+	for i := 0; i < p.size; i++ {
+		d := NewDriverAt(p.bin)
+		d.Format = p.Format
+		d.Schema = p.Schema
+		if err := d.Start(); err != nil {
+			for _, w := range workers {
+				_ = w.Close()
+			}
+			return err
+		}
+		workers = append(workers, &worker{Driver: d})
+	}
+	p.workers = workers
+	p.running = true
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.checkLoop(p.stop, p.done)
+	return nil
+}
+
+// Parse sends the request to the least loaded native parser in the pool.
+//
+// Documents are always parsed by the same native parser (see Driver.Parse and Document).
+func (p *Pool) Parse(ctx context.Context, src string) (nodes.Node, error) {
+	if id := documentID(ctx); id != "" {
+		return p.docs.parse(ctx, id, src, p.NewDocument)
+	}
+	w, err := p.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer p.release(w)
+	return w.Parse(ctx, src)
+}
+
+// acquire selects the least loaded worker and reserves it for a request.
+func (p *Pool) acquire() (*worker, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.running {
+		return nil, driver.ErrDriverFailure.Wrap(native.ErrNotRunning.New())
+	}
+	var best *worker
+	for i := range p.workers {
+		w := p.workers[(p.next+i)%len(p.workers)]
+		if best == nil || w.load < best.load {
+			best = w
+		}
+	}
+	p.next = (p.next + 1) % len(p.workers)
+	best.load++
+	p.reqs.Add(1)
+	return best, nil
+}
+
+// acquireWorker reserves a given worker for a request.
+func (p *Pool) acquireWorker(w *worker) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.running {
+		return driver.ErrDriverFailure.Wrap(native.ErrNotRunning.New())
+	}
+	w.load++
+	p.reqs.Add(1)
+	return nil
+}
+
+// release marks the request to the worker as finished.
+func (p *Pool) release(w *worker) {
+	p.mu.Lock()
+	w.load--
+	p.mu.Unlock()
+	p.reqs.Done()
+}
+
+// checkLoop periodically checks the health of idle workers, until the stop channel is closed.
+func (p *Pool) checkLoop(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for _, w := range p.workers {
+			p.mu.Lock()
+			idle := w.load == 0
+			p.mu.Unlock()
+			if !idle {
+				// it processes requests; failures will be handled there
+				continue
+			}
+			// reserve the worker, so requests are sent to other workers during the check
+			if err := p.acquireWorker(w); err != nil {
+				// the pool is closed
+				return
+			}
+			_ = w.check(healthTimeout)
+			p.release(w)
+		}
+	}
+}
+
+// Close stops accepting new requests, waits for pending requests and stops all native parsers.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if !p.running {
+		p.mu.Unlock()
+		return nil
+	}
+	p.running = false
+	close(p.stop)
+	p.mu.Unlock()
+
+	<-p.done
+	// trees of documents are discarded with native parsers; documents that are being closed
+	// either fail to acquire a parser, or are counted as pending requests
+	p.docs.reset()
+	p.reqs.Wait()
+
+	var last error
+	for _, w := range p.workers {
+		if err := w.Close(); err != nil {
+			last = err
+		}
+	}
+	return last
+}
@@ -0,0 +1,147 @@
+package impl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bblfsh/sdk/v3/driver/native"
+)
+
+// newFakePool starts a pool of fake native parsers (see fakeParser).
+func newFakePool(t testing.TB, size int) (*Pool, func()) {
+	bin, remove := writeFakeParser(t)
+	p := NewPoolAt(bin, size)
+	p.Format, p.Schema = WireJSON, SchemaFull
+	if err := p.Start(); err != nil {
+		remove()
+		t.Fatal(err)
+	}
+	return p, func() {
+		p.Close()
+		remove()
+	}
+}
+
+func TestPoolLeastLoaded(t *testing.T) {
+	p, closer := newFakePool(t, 3)
+	defer closer()
+
+	acquire := func() *worker {
+		w, err := p.acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	// idle workers are chosen first
+	w1, w2, w3 := acquire(), acquire(), acquire()
+	if w1 == w2 || w1 == w3 || w2 == w3 {
+		t.Fatal("expected requests to be sent to different workers")
+	}
+	p.release(w2)
+	if w := acquire(); w != w2 {
+		t.Fatal("expected the request to be sent to the idle worker")
+	}
+	// all workers have the same load, thus they are chosen in a round-robin order
+	seen := make(map[*worker]bool)
+	for i := 0; i < 3; i++ {
+		seen[acquire()] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected requests to be distributed between all workers, got %d", len(seen))
+	}
+	for _, w := range p.workers {
+		if w.load != 2 {
+			t.Fatalf("unexpected load: %d", w.load)
+		}
+		p.release(w)
+		p.release(w)
+	}
+}
+
+func TestPoolRestart(t *testing.T) {
+	p, closer := newFakePool(t, 1)
+	defer closer()
+	w := p.workers[0]
+
+	// the parser crashes while processing the request
+	cmd := w.cmd
+	_, err := p.Parse(context.Background(), "crash")
+	if !native.ErrDriverCrashed.Is(err) {
+		t.Fatalf("expected a crash, got: %v", err)
+	}
+	if _, err = p.Parse(context.Background(), "ok"); err != nil {
+		t.Fatal(err)
+	}
+	if w.cmd == cmd {
+		t.Fatal("expected the parser to be restarted")
+	}
+
+	// the parser dies between requests
+	cmd = w.cmd
+	if err = w.cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !w.exited(); {
+		if time.Now().After(deadline) {
+			t.Fatal("the parser has not exited")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err = p.Parse(context.Background(), "ok"); err != nil {
+		t.Fatal(err)
+	}
+	if w.cmd == cmd {
+		t.Fatal("expected the parser to be restarted")
+	}
+
+	// the health check restarts the parser that died
+	cmd = w.cmd
+	if err = w.cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	// the check may fail or succeed, depending on when the parser exits
+	_ = w.check(time.Second)
+	if w.cmd == cmd || w.broken {
+		t.Fatal("expected the parser to be restarted by the health check")
+	}
+}
+
+func TestPoolCloseWaits(t *testing.T) {
+	p, closer := newFakePool(t, 2)
+	defer closer()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := p.Parse(context.Background(), "delay")
+		errc <- err
+	}()
+	// wait for the request to be sent
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		p.mu.Lock()
+		load := p.workers[0].load + p.workers[1].load
+		p.mu.Unlock()
+		if load != 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("the request was not sent")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("Close must wait for pending requests")
+	}
+	// new requests are rejected
+	if _, err := p.Parse(context.Background(), "ok"); !native.ErrNotRunning.Is(err) {
+		t.Fatalf("expected an error, got: %v", err)
+	}
+}
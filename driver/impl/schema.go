@@ -0,0 +1,83 @@
+package impl
+
+import (
+	"os"
+
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+)
+
+const (
+	// envSchema is the name of an environment variable with the default schema of native ASTs.
+	envSchema = "CSHARP_DRIVER_SCHEMA"
+
+	// keySchemaDefaults is a field of the root node that stores values of fields omitted from
+	// the lean native AST. See SchemaLean.
+	keySchemaDefaults = "SchemaDefaults"
+)
+
+// Schema is a schema of native ASTs sent by the native parser.
+type Schema string
+
+const (
+	// SchemaFull includes all fields of Roslyn syntax nodes and tokens. It's the default schema,
+	// and is used by the fixtures of the driver.
+	SchemaFull = Schema("full")
+	// SchemaLean omits redundant fields from the native AST. It must be enabled explicitly.
+	//
+	// The following fields are omitted:
+	//
+	//   - IsMissing, IsStructuredTrivia, IsVar, IsUnmanaged and Arity, if they have a default
+	//     value. The values are reported in the SchemaDefaults field of the root node, by node type;
+	//   - Value and ValueText of tokens, if they are the same as Text;
+	//   - whitespace and end of line trivia.
+	//
+	// Transformations of the driver restore omitted fields before processing the AST, thus
+	// the resulting UAST is the same for both schemas.
+	SchemaLean = Schema("lean")
+)
+
+// schemaFromEnv returns the default schema, as set in the environment.
+func schemaFromEnv() Schema {
+	if s := Schema(os.Getenv(envSchema)); s != "" {
+		return s
+	}
+	return SchemaFull
+}
+
+// withSchemaDefaults stores default values of omitted fields in the root node of the lean AST.
+func withSchemaDefaults(ast nodes.Node, defaults nodes.Object) nodes.Node {
+	root, ok := ast.(nodes.Object)
+	if !ok || len(defaults) == 0 {
+		return ast
+	}
+	root = root.CloneObject()
+	root[keySchemaDefaults] = defaults
+	return root
+}
+
+// mergeSchemaDefaults merges default values of omitted fields from all roots of the lean AST.
+// It returns nil, if none of the roots have defaults.
+func mergeSchemaDefaults(roots []nodes.Node) nodes.Object {
+	var out nodes.Object
+	for _, r := range roots {
+		root, _ := r.(nodes.Object)
+		defaults, _ := root[keySchemaDefaults].(nodes.Object)
+		for typ, f := range defaults {
+			fields, _ := f.(nodes.Object)
+			if out == nil {
+				out = make(nodes.Object, len(defaults))
+			}
+			cur, _ := out[typ].(nodes.Object)
+			if cur == nil {
+				out[typ] = fields
+				continue
+			}
+			cur = cur.CloneObject()
+			for k, v := range fields {
+				cur[k] = v
+			}
+			out[typ] = cur
+		}
+	}
+	return out
+}
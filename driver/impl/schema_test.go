@@ -0,0 +1,22 @@
+package impl
+
+import "testing"
+
+func TestSchemaFromEnv(t *testing.T) {
+	restore := setEnv(map[string]string{envSchema: ""})
+	defer restore()
+	if s := schemaFromEnv(); s != SchemaFull {
+		t.Fatalf("expected the full schema by default, got: %q", s)
+	}
+	if d := NewDriverAt("native"); d.Schema != SchemaFull {
+		t.Fatalf("unexpected schema of the driver: %q", d.Schema)
+	}
+
+	setEnv(map[string]string{envSchema: string(SchemaLean)})
+	if s := schemaFromEnv(); s != SchemaLean {
+		t.Fatalf("expected the lean schema, got: %q", s)
+	}
+	if p := NewPoolAt("native", 1); p.Schema != SchemaLean {
+		t.Fatalf("unexpected schema of the pool: %q", p.Schema)
+	}
+}
@@ -0,0 +1,203 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+
+	"github.com/bblfsh/sdk/v3/driver"
+	"github.com/bblfsh/sdk/v3/protocol"
+	"github.com/bblfsh/sdk/v3/uast/nodes/nodesproto"
+	"google.golang.org/grpc"
+	serrors "gopkg.in/src-d/go-errors.v1"
+)
+
+const (
+	// envBatchAddress is the name of an environment variable with the address of the gRPC server
+	// for batch requests (see RegisterBatchService). The server is not started, if it's not set.
+	envBatchAddress = "CSHARP_DRIVER_BATCH_ADDRESS"
+
+	// maxStreamBatch is the maximal number of files received from the stream that are parsed together.
+	maxStreamBatch = 16 * batchSize
+
+	// language is the language of the driver, as reported in responses.
+	language = "csharp"
+)
+
+// RegisterBatchService registers a gRPC service that parses a stream of files with batch requests
+// to the native driver (see Pool.ParseBatch).
+//
+// The service has a single bidirectional streaming method:
+//
+//	/csharp.BatchDriver/ParseBatch (stream ParseRequest) returns (stream ParseResponse)
+//
+// Requests and responses are messages of the bblfsh v2 protocol. A response is sent for each request,
+// in the same order, as soon as the file is parsed and transformed. Errors are reported for each file
+// in the Errors field of the response, thus a failure of a single file doesn't stop the stream.
+// Files that the client sends without waiting for responses are parsed together.
+//
+// Parse options are taken from the stream metadata, the same way as for Parse requests.
+func RegisterBatchService(srv *grpc.Server, d driver.Native, t driver.Transforms) {
+	srv.RegisterService(&batchServiceDesc, &batchService{d: d, t: t})
+}
+
+// batchHandler is a server API of the batch service.
+type batchHandler interface {
+	parseBatch(stream grpc.ServerStream) error
+}
+
+var batchServiceDesc = grpc.ServiceDesc{
+	ServiceName: "csharp.BatchDriver",
+	HandlerType: (*batchHandler)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName: "ParseBatch",
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			return srv.(batchHandler).parseBatch(stream)
+		},
+		ServerStreams: true,
+		ClientStreams: true,
+	}},
+}
+
+// batchService implements the batch service for a native driver.
+type batchService struct {
+	d driver.Native
+	t driver.Transforms
+}
+
+func (s *batchService) parseBatch(stream grpc.ServerStream) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	reqs := make(chan *protocol.ParseRequest, maxStreamBatch)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(reqs)
+		for {
+			req := new(protocol.ParseRequest)
+			if err := stream.RecvMsg(req); err == io.EOF {
+				return
+			} else if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for req := range reqs {
+		batch := []*protocol.ParseRequest{req}
+		// parse together all the files that are already received
+	drain:
+		for len(batch) < maxStreamBatch {
+			select {
+			case req, ok := <-reqs:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, req)
+			default:
+				break drain
+			}
+		}
+		files := make([]File, 0, len(batch))
+		for _, r := range batch {
+			files = append(files, File{Path: r.Filename, Content: r.Content})
+		}
+		i := 0
+		for res := range parseBatch(ctx, s.d, files) {
+			if err := stream.SendMsg(s.response(ctx, batch[i], res)); err != nil {
+				return err
+			}
+			i++
+		}
+		if i != len(batch) {
+			// the stream was canceled
+			return ctx.Err()
+		}
+	}
+	select {
+	case err := <-errc:
+		return err
+	default:
+		return nil
+	}
+}
+
+// response transforms the native AST of the file and returns a response for it. Results are the same
+// as for a Parse request, but errors are reported in the response instead of the gRPC status.
+func (s *batchService) response(ctx context.Context, req *protocol.ParseRequest, res FileResult) *protocol.ParseResponse {
+	resp := &protocol.ParseResponse{Language: language}
+	ast, err := res.AST, res.Err
+	if err != nil {
+		resp.Errors = parseErrors(err)
+		if driver.ErrDriverFailure.Is(err) {
+			return resp
+		}
+		// syntax errors are returned with the native AST (see driver.NewDriverFrom)
+	} else if ast, err = s.t.Do(ctx, driver.Mode(req.Mode), req.Content, ast); err != nil {
+		resp.Errors = parseErrors(err)
+		return resp
+	}
+	buf := new(bytes.Buffer)
+	if err = nodesproto.WriteTo(buf, ast); err != nil {
+		resp.Errors = append(resp.Errors, parseErrors(err)...)
+		return resp
+	}
+	resp.Uast = buf.Bytes()
+	return resp
+}
+
+// parseErrors converts the error to a list of errors of the response.
+func parseErrors(err error) []*protocol.ParseError {
+	if e, ok := err.(*serrors.Error); ok && e.Cause() != nil {
+		err = e.Cause()
+	}
+	errs := []error{err}
+	if e, ok := err.(*driver.ErrMulti); ok {
+		errs = e.Errors
+	}
+	out := make([]*protocol.ParseError, 0, len(errs))
+	for _, e := range errs {
+		out = append(out, &protocol.ParseError{Text: e.Error()})
+	}
+	return out
+}
+
+// batchListener is a native driver that serves the batch service (see RegisterBatchService) on
+// a separate listener while it's running. The gRPC server of the SDK can't serve other services.
+type batchListener struct {
+	driver.Native
+	addr string
+	t    driver.Transforms
+
+	srv *grpc.Server
+}
+
+// Start implements driver.Native.
+func (d *batchListener) Start() error {
+	if err := d.Native.Start(); err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", d.addr)
+	if err != nil {
+		d.Native.Close()
+		return err
+	}
+	d.srv = grpc.NewServer(protocol.ServerOptions()...)
+	RegisterBatchService(d.srv, d.Native, d.t)
+	go d.srv.Serve(l)
+	return nil
+}
+
+// Close implements driver.Native.
+func (d *batchListener) Close() error {
+	if d.srv != nil {
+		d.srv.Stop()
+	}
+	return d.Native.Close()
+}
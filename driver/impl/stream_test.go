@@ -0,0 +1,87 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/bblfsh/sdk/v3/driver"
+	"github.com/bblfsh/sdk/v3/protocol"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	"github.com/bblfsh/sdk/v3/uast/nodes/nodesproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestBatchService(t *testing.T) {
+	p, closer := newFakePool(t, 2)
+	defer closer()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	RegisterBatchService(srv, p, driver.Transforms{})
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	ctx := context.Background()
+	stream, err := cc.NewStream(ctx, &batchServiceDesc.Streams[0], "/csharp.BatchDriver/ParseBatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make([]string, batchSize+10)
+	for i := range contents {
+		contents[i] = fmt.Sprintf("file%d", i)
+	}
+	contents[3] = "huge"
+	for i, c := range contents {
+		err = stream.SendMsg(&protocol.ParseRequest{
+			Filename: fmt.Sprintf("%d.cs", i), Content: c, Mode: protocol.Mode_Native,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		var resp protocol.ParseResponse
+		err = stream.RecvMsg(&resp)
+		if err == io.EOF {
+			if i != len(contents) {
+				t.Fatalf("expected %d responses, got %d", len(contents), i)
+			}
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if i == 3 {
+			// a failure of a single file doesn't stop the stream
+			if len(resp.Errors) != 1 || len(resp.Uast) != 0 {
+				t.Fatalf("expected an error, got: %v", resp)
+			}
+			continue
+		}
+		if len(resp.Errors) != 0 {
+			t.Fatalf("unexpected errors: %v", resp.Errors)
+		}
+		ast, err := nodesproto.ReadTree(bytes.NewReader(resp.Uast))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj, _ := ast.(nodes.Object); obj["content"] != nodes.String(contents[i]) {
+			t.Fatalf("unexpected AST at %d: %v", i, ast)
+		}
+	}
+}
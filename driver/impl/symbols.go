@@ -0,0 +1,304 @@
+package impl
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// envSymbols is the name of an environment variable with a default list of preprocessor
+	// symbols separated by semicolons, the same way as in DefineConstants of MSBuild.
+	envSymbols = "CSHARP_DRIVER_SYMBOLS"
+	// envSymbolSets is the name of an environment variable with a default list of preprocessor
+	// symbol sets. Sets are separated by '|', and symbols in each set - by semicolons.
+	envSymbolSets = "CSHARP_DRIVER_SYMBOL_SETS"
+	// envLanguageVersion is the name of an environment variable with a default C# language version.
+	envLanguageVersion = "CSHARP_DRIVER_LANG_VERSION"
+	// envTimeout is the name of an environment variable with a default timeout for a single
+	// parse request, in the format accepted by time.ParseDuration.
+	envTimeout = "CSHARP_DRIVER_TIMEOUT"
+	// envMaxSize is the name of an environment variable with a default limit of the native
+	// AST size in bytes.
+	envMaxSize = "CSHARP_DRIVER_MAX_SIZE"
+
+	// typeVariant is a type of the node that stores nodes parsed with a different symbol set.
+	typeVariant = "ParseVariant"
+)
+
+// ParseOptions are additional options for the C# parser.
+type ParseOptions struct {
+	// Symbols is a list of preprocessor symbols defined for the file.
+	Symbols []string
+	// SymbolSets is a list of preprocessor symbol sets. If set, the file will be parsed once
+	// per set and the results will be merged. Symbols are added to each set.
+	SymbolSets [][]string
+	// LanguageVersion is a C# language version, in the same format as LangVersion project property,
+	// for example "7.3" or "latest". Default language version of the parser is used, if not set.
+	LanguageVersion string
+	// Timeout is the maximal duration of the parse request. If the native parser doesn't
+	// respond in time, it is restarted and ErrTimeout is returned. No limit, if not set.
+	// It can't exceed the default timeout set in the environment.
+	Timeout time.Duration
+	// MaxSize is the maximal size of the native AST in bytes, as sent by the native parser.
+	// If the AST is larger, the native parser drops it and ErrTooLarge is returned. No limit, if not set.
+	// It can't exceed the default limit set in the environment.
+	MaxSize int
+}
+
+// symbolSets returns the list of symbol sets the file should be parsed with.
+// It always returns at least one set.
+func (opts ParseOptions) symbolSets() [][]string {
+	if len(opts.SymbolSets) == 0 {
+		return [][]string{opts.Symbols}
+	}
+	sets := make([][]string, 0, len(opts.SymbolSets))
+	for _, set := range opts.SymbolSets {
+		s := make([]string, 0, len(opts.Symbols)+len(set))
+		s = append(s, opts.Symbols...)
+		s = append(s, set...)
+		sets = append(sets, s)
+	}
+	return sets
+}
+
+type parseOptionsKey struct{}
+
+// WithParseOptions returns a context with parse options for the C# driver.
+//
+// Parse options that are not set in the context are taken from gRPC metadata of the request
+// (see metadataKeys) and then from the environment. A non-nil empty list of symbols or symbol
+// sets overrides the default one. The timeout and the size limit can only be lowered.
+func WithParseOptions(ctx context.Context, opts ParseOptions) context.Context {
+	return context.WithValue(ctx, parseOptionsKey{}, opts)
+}
+
+// optionKeys are names of the values that store parse options.
+type optionKeys struct {
+	Symbols, SymbolSets, LanguageVersion, Timeout, MaxSize string
+}
+
+var (
+	// envKeys are names of environment variables with default parse options.
+	envKeys = optionKeys{
+		Symbols:         envSymbols,
+		SymbolSets:      envSymbolSets,
+		LanguageVersion: envLanguageVersion,
+		Timeout:         envTimeout,
+		MaxSize:         envMaxSize,
+	}
+	// metadataKeys are names of gRPC metadata keys with parse options for a single request.
+	// Values have the same format as the corresponding environment variables.
+	metadataKeys = optionKeys{
+		Symbols:         "csharp-symbols",
+		SymbolSets:      "csharp-symbol-sets",
+		LanguageVersion: "csharp-lang-version",
+		Timeout:         "csharp-timeout",
+		MaxSize:         "csharp-max-size",
+	}
+)
+
+// parseOptionsFrom returns parse options for the request. Options set in the context override
+// options from gRPC metadata, which override default options (see WithParseOptions).
+func parseOptionsFrom(ctx context.Context) ParseOptions {
+	opts := defaultParseOptions()
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		opts = opts.merge(readParseOptions(metadataKeys, func(key string) string {
+			if vals := md.Get(key); len(vals) != 0 {
+				return vals[0]
+			}
+			return ""
+		}))
+	}
+	if o, ok := ctx.Value(parseOptionsKey{}).(ParseOptions); ok {
+		opts = opts.merge(o)
+	}
+	return opts
+}
+
+// merge returns a copy of parse options with all the fields set in o replaced.
+// Limits can only be tightened: the timeout and the size limit are replaced only if they are stricter.
+func (opts ParseOptions) merge(o ParseOptions) ParseOptions {
+	if o.Symbols != nil {
+		opts.Symbols = o.Symbols
+	}
+	if o.SymbolSets != nil {
+		opts.SymbolSets = o.SymbolSets
+	}
+	if o.LanguageVersion != "" {
+		opts.LanguageVersion = o.LanguageVersion
+	}
+	if o.Timeout > 0 && (opts.Timeout <= 0 || o.Timeout < opts.Timeout) {
+		opts.Timeout = o.Timeout
+	}
+	if o.MaxSize > 0 && (opts.MaxSize <= 0 || o.MaxSize < opts.MaxSize) {
+		opts.MaxSize = o.MaxSize
+	}
+	return opts
+}
+
+// defaultParseOptions returns parse options set by environment variables.
+func defaultParseOptions() ParseOptions {
+	return readParseOptions(envKeys, os.Getenv)
+}
+
+// readParseOptions reads parse options from values with given keys. Unset and invalid
+// values are ignored.
+func readParseOptions(keys optionKeys, get func(key string) string) ParseOptions {
+	var opts ParseOptions
+	opts.Symbols = splitSymbols(get(keys.Symbols))
+	opts.LanguageVersion = get(keys.LanguageVersion)
+	if d, err := time.ParseDuration(get(keys.Timeout)); err == nil && d > 0 {
+		opts.Timeout = d
+	}
+	if n, err := strconv.Atoi(get(keys.MaxSize)); err == nil && n > 0 {
+		opts.MaxSize = n
+	}
+	if s := get(keys.SymbolSets); s != "" {
+		for _, set := range strings.Split(s, "|") {
+			opts.SymbolSets = append(opts.SymbolSets, splitSymbols(set))
+		}
+	}
+	return opts
+}
+
+// splitSymbols splits a list of preprocessor symbols separated by semicolons or commas.
+func splitSymbols(s string) []string {
+	var out []string
+	for _, sym := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ';' || r == ','
+	}) {
+		if sym = strings.TrimSpace(sym); sym != "" {
+			out = append(out, sym)
+		}
+	}
+	return out
+}
+
+// mergeVariants merges native ASTs of the same file parsed with different symbol sets.
+//
+// The first AST is used as a base. Code that is disabled in it, but enabled with other symbol
+// sets is added to the Variants field of the root node. Each variant stores the list of symbols
+// and top-most nodes that belong to the code disabled in the base AST.
+//
+// If the file cannot be parsed with one of the other symbol sets, its error is set in the Error
+// field of the variant, and the variant has no nodes. The base AST must always be set.
+func mergeVariants(roots []nodes.Node, sets [][]string, errs []error) nodes.Node {
+	root, ok := roots[0].(nodes.Object)
+	if !ok {
+		return roots[0]
+	}
+	disabled := disabledSpans(root)
+	variants := make(nodes.Array, 0, len(roots)-1)
+	for i, r := range roots[1:] {
+		syms := make(nodes.Array, 0, len(sets[i+1]))
+		for _, s := range sets[i+1] {
+			syms = append(syms, nodes.String(s))
+		}
+		v := nodes.Object{
+			uast.KeyType: nodes.String(typeVariant),
+			"Symbols":    syms,
+			"Nodes":      enabledNodes(r, disabled),
+		}
+		if err := errs[i+1]; err != nil {
+			v["Nodes"] = nodes.Array{}
+			v["Error"] = nodes.String(err.Error())
+		}
+		variants = append(variants, v)
+	}
+	root = root.CloneObject()
+	root["Variants"] = variants
+	if defaults := mergeSchemaDefaults(roots); defaults != nil {
+		root[keySchemaDefaults] = defaults
+	}
+	return root
+}
+
+// span is a range of the source code.
+type span struct {
+	start, end int64
+}
+
+// spanOf returns a span from the given TextSpan field of the native AST node.
+func spanOf(obj nodes.Object, field string) (span, bool) {
+	sp, ok := obj[field].(nodes.Object)
+	if !ok {
+		return span{}, false
+	}
+	start, ok1 := intValue(sp["Start"])
+	end, ok2 := intValue(sp["End"])
+	return span{start: start, end: end}, ok1 && ok2
+}
+
+func intValue(n nodes.Node) (int64, bool) {
+	switch n := n.(type) {
+	case nodes.Int:
+		return int64(n), true
+	case nodes.Uint:
+		return int64(n), true
+	case nodes.Float:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// disabledSpans returns spans of all disabled text trivias in the native AST.
+func disabledSpans(root nodes.Node) []span {
+	var out []span
+	nodes.WalkPreOrder(root, func(n nodes.Node) bool {
+		obj, ok := n.(nodes.Object)
+		if !ok {
+			return true
+		}
+		if uast.TypeOf(obj) != "DisabledTextTrivia" {
+			return true
+		}
+		if sp, ok := spanOf(obj, "FullSpan"); ok {
+			out = append(out, sp)
+		}
+		return false
+	})
+	return out
+}
+
+// enabledNodes returns top-most nodes of the native AST that are located inside one of the spans.
+// Trivia are not considered, since directives are the same in all variants.
+func enabledNodes(root nodes.Node, spans []span) nodes.Array {
+	out := nodes.Array{}
+	if len(spans) == 0 {
+		return out
+	}
+	var visit func(n nodes.Node)
+	visit = func(n nodes.Node) {
+		switch n := n.(type) {
+		case nodes.Array:
+			for _, s := range n {
+				visit(s)
+			}
+		case nodes.Object:
+			if sp, ok := spanOf(n, "Span"); ok && sp.end > sp.start {
+				for _, d := range spans {
+					if d.start <= sp.start && sp.end <= d.end {
+						out = append(out, n)
+						return
+					}
+				}
+			}
+			for _, k := range n.Keys() {
+				switch k {
+				case "LeadingTrivia", "TrailingTrivia", "Span", "FullSpan":
+					continue
+				}
+				visit(n[k])
+			}
+		}
+	}
+	visit(root)
+	return out
+}
@@ -0,0 +1,221 @@
+package impl
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	"google.golang.org/grpc/metadata"
+)
+
+// setEnv sets environment variables and returns a function that restores them.
+func setEnv(kv map[string]string) func() {
+	old := make(map[string]*string, len(kv))
+	for k, v := range kv {
+		if prev, ok := os.LookupEnv(k); ok {
+			old[k] = &prev
+		} else {
+			old[k] = nil
+		}
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, v := range old {
+			if v != nil {
+				os.Setenv(k, *v)
+			} else {
+				os.Unsetenv(k)
+			}
+		}
+	}
+}
+
+func TestParseOptionsDefaults(t *testing.T) {
+	defer setEnv(map[string]string{
+		envSymbols:         "DEBUG; TRACE",
+		envSymbolSets:      "NET45|NETCORE;NET5",
+		envLanguageVersion: "7.3",
+		envTimeout:         "10s",
+		envMaxSize:         "invalid",
+	})()
+	exp := ParseOptions{
+		Symbols:         []string{"DEBUG", "TRACE"},
+		SymbolSets:      [][]string{{"NET45"}, {"NETCORE", "NET5"}},
+		LanguageVersion: "7.3",
+		Timeout:         10 * time.Second,
+	}
+	if got := parseOptionsFrom(context.Background()); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("unexpected options:\n%+v\nvs\n%+v", exp, got)
+	}
+}
+
+func TestParseOptionsMerge(t *testing.T) {
+	defer setEnv(map[string]string{
+		envSymbols:         "DEBUG",
+		envSymbolSets:      "",
+		envLanguageVersion: "7.3",
+		envTimeout:         "10s",
+		envMaxSize:         "1000",
+	})()
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"csharp-symbol-sets", "A|B",
+		"csharp-max-size", "2000",
+	))
+	ctx = WithParseOptions(ctx, ParseOptions{
+		Symbols:         []string{},
+		LanguageVersion: "latest",
+	})
+	exp := ParseOptions{
+		Symbols:         []string{},
+		SymbolSets:      [][]string{{"A"}, {"B"}},
+		LanguageVersion: "latest",
+		Timeout:         10 * time.Second,
+		MaxSize:         1000,
+	}
+	if got := parseOptionsFrom(ctx); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("unexpected options:\n%+v\nvs\n%+v", exp, got)
+	}
+}
+
+func TestParseOptionsLimits(t *testing.T) {
+	defer setEnv(map[string]string{
+		envTimeout: "10s",
+		envMaxSize: "",
+	})()
+	md := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"csharp-timeout", "1m",
+		"csharp-max-size", "2000",
+	))
+	// limits of the environment can't be raised by the request
+	got := parseOptionsFrom(md)
+	if got.Timeout != 10*time.Second || got.MaxSize != 2000 {
+		t.Fatalf("unexpected limits: %v, %d", got.Timeout, got.MaxSize)
+	}
+	got = parseOptionsFrom(WithParseOptions(md, ParseOptions{Timeout: time.Minute, MaxSize: 3000}))
+	if got.Timeout != 10*time.Second || got.MaxSize != 2000 {
+		t.Fatalf("unexpected limits: %v, %d", got.Timeout, got.MaxSize)
+	}
+	// but they can be lowered
+	got = parseOptionsFrom(WithParseOptions(md, ParseOptions{Timeout: time.Second, MaxSize: 1000}))
+	if got.Timeout != time.Second || got.MaxSize != 1000 {
+		t.Fatalf("unexpected limits: %v, %d", got.Timeout, got.MaxSize)
+	}
+}
+
+func TestSymbolSets(t *testing.T) {
+	opts := ParseOptions{Symbols: []string{"DEBUG"}}
+	if got, exp := opts.symbolSets(), [][]string{{"DEBUG"}}; !reflect.DeepEqual(exp, got) {
+		t.Fatalf("unexpected sets: %q", got)
+	}
+	opts.SymbolSets = [][]string{{}, {"NET45"}}
+	if got, exp := opts.symbolSets(), [][]string{{"DEBUG"}, {"DEBUG", "NET45"}}; !reflect.DeepEqual(exp, got) {
+		t.Fatalf("unexpected sets: %q", got)
+	}
+}
+
+// textSpan returns a native TextSpan node.
+func textSpan(start, end int) nodes.Object {
+	return nodes.Object{
+		uast.KeyType: nodes.String("TextSpan"),
+		"Start":      nodes.Int(start),
+		"End":        nodes.Int(end),
+	}
+}
+
+// spanNode returns a native node with a given type and span.
+func spanNode(typ string, start, end int) nodes.Object {
+	return nodes.Object{
+		uast.KeyType: nodes.String(typ),
+		"Span":       textSpan(start, end),
+		"FullSpan":   textSpan(start, end),
+	}
+}
+
+// variantRoots returns native ASTs of the following file parsed with and without symbol A:
+//
+//	class C {
+//	#if A
+//	    void M() {}
+//	#endif
+//	}
+func variantRoots() (base, variant nodes.Object) {
+	disabled := spanNode("DisabledTextTrivia", 16, 28)
+	brace := spanNode("CloseBraceToken", 35, 36)
+	brace["LeadingTrivia"] = nodes.Array{spanNode("IfDirectiveTrivia", 10, 16), disabled}
+	base = spanNode("CompilationUnit", 0, 36)
+	base["Members"] = nodes.Array{nodes.Object{
+		uast.KeyType:      nodes.String("ClassDeclaration"),
+		"Span":            textSpan(0, 36),
+		"Members":         nodes.Array{},
+		"CloseBraceToken": brace,
+	}}
+
+	method := spanNode("MethodDeclaration", 20, 27)
+	method["Body"] = spanNode("Block", 25, 27)
+	variant = spanNode("CompilationUnit", 0, 36)
+	variant["Members"] = nodes.Array{nodes.Object{
+		uast.KeyType:      nodes.String("ClassDeclaration"),
+		"Span":            textSpan(0, 36),
+		"Members":         nodes.Array{method},
+		"CloseBraceToken": spanNode("CloseBraceToken", 35, 36),
+	}}
+	return base, variant
+}
+
+func TestDisabledSpans(t *testing.T) {
+	base, variant := variantRoots()
+	if got, exp := disabledSpans(base), []span{{start: 16, end: 28}}; !reflect.DeepEqual(exp, got) {
+		t.Fatalf("unexpected spans: %v", got)
+	}
+	if got := disabledSpans(variant); len(got) != 0 {
+		t.Fatalf("unexpected spans: %v", got)
+	}
+}
+
+func TestEnabledNodes(t *testing.T) {
+	_, variant := variantRoots()
+	method := variant["Members"].(nodes.Array)[0].(nodes.Object)["Members"].(nodes.Array)[0]
+
+	got := enabledNodes(variant, []span{{start: 16, end: 28}})
+	if exp := (nodes.Array{method}); !nodes.Equal(exp, got) {
+		t.Fatalf("unexpected nodes: %v", got)
+	}
+	if got := enabledNodes(variant, nil); got == nil || len(got) != 0 {
+		t.Fatalf("unexpected nodes: %v", got)
+	}
+}
+
+func TestMergeVariants(t *testing.T) {
+	base, variant := variantRoots()
+	method := variant["Members"].(nodes.Array)[0].(nodes.Object)["Members"].(nodes.Array)[0]
+
+	sets := [][]string{{"DEBUG"}, {"DEBUG", "A"}, {"DEBUG", "B"}}
+	errs := []error{nil, nil, errors.New("native parser timed out")}
+	got := mergeVariants([]nodes.Node{base, variant, nil}, sets, errs)
+
+	exp := base.CloneObject()
+	exp["Variants"] = nodes.Array{
+		nodes.Object{
+			uast.KeyType: nodes.String(typeVariant),
+			"Symbols":    nodes.Array{nodes.String("DEBUG"), nodes.String("A")},
+			"Nodes":      nodes.Array{method},
+		},
+		nodes.Object{
+			uast.KeyType: nodes.String(typeVariant),
+			"Symbols":    nodes.Array{nodes.String("DEBUG"), nodes.String("B")},
+			"Nodes":      nodes.Array{},
+			"Error":      nodes.String("native parser timed out"),
+		},
+	}
+	if !nodes.Equal(exp, got) {
+		t.Fatalf("unexpected AST:\n%v\nvs\n%v", exp, got)
+	}
+	if _, ok := base["Variants"]; ok {
+		t.Fatal("base AST was modified")
+	}
+}
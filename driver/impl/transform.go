@@ -0,0 +1,301 @@
+package impl
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/bblfsh/sdk/v3/driver"
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+)
+
+// typeMemberRef is a type of the node that replaces a member of the native AST while the rest
+// of the AST is transformed. See Document.Transform.
+const typeMemberRef = "MemberRef"
+
+// uastMember is a member of the native AST transformed separately from the rest of the AST.
+type uastMember struct {
+	node nodes.Node
+	// start is the position of the member in the source it was transformed for
+	start uast.Position
+}
+
+// Transform converts the last AST returned by Parse or Edit with given transformations. Results are
+// the same as for t.Do.
+//
+// Members of namespaces and types (methods, fields, properties, etc) are transformed separately from
+// the rest of the AST, and are kept for the following calls. Members that were reused from the previous
+// AST of the document are not transformed again, only their positions are updated. Thus, after a small
+// edit only the changed members and the namespaces and types that contain them are transformed.
+// Members with syntax errors or preprocessor directives, and members that don't start on a new line,
+// are transformed together with the rest of the AST.
+//
+// All calls must use the same transformations. Members are transformed again if the mode changes.
+func (doc *Document) Transform(ctx context.Context, t driver.Transforms, mode driver.Mode) (nodes.Node, error) {
+	if doc.last == nil {
+		return nil, errors.New("the document is not parsed")
+	}
+	if mode == 0 {
+		mode = driver.ModeDefault
+	}
+	root, ok := doc.last.(nodes.Object)
+	if mode == driver.ModeNative || !ok {
+		return t.Do(ctx, mode, doc.src, doc.last)
+	}
+	if mode != doc.mode {
+		doc.members, doc.mode = nil, mode
+	}
+	sp := newMemberSplitter(doc.src, root, doc.members)
+	skel, _ := sp.split(root)
+	ast, err := t.Do(ctx, mode, doc.src, skel)
+	if err != nil {
+		return nil, driver.ErrTransformFailure.Wrap(err)
+	}
+	members := make(map[span]*uastMember, len(sp.refs))
+	out := make([]nodes.Node, 0, len(sp.refs))
+	for _, m := range sp.refs {
+		pos := sp.pos[m.span]
+		um := doc.members[m.span]
+		if um == nil || !canMove(um.start, pos) {
+			obj := m.node
+			if defaults, ok := root[keySchemaDefaults]; ok {
+				// see restoreLean
+				obj = obj.CloneObject()
+				obj[keySchemaDefaults] = defaults
+			}
+			n, err := t.Do(ctx, mode, doc.src, obj)
+			if err != nil {
+				return nil, driver.ErrTransformFailure.Wrap(err)
+			}
+			um = &uastMember{node: n, start: pos}
+		} else if um.start != pos {
+			um = &uastMember{
+				node:  shiftPositions(um.node, int64(pos.Offset)-int64(um.start.Offset), int64(pos.Line)-int64(um.start.Line)),
+				start: pos,
+			}
+		}
+		members[m.span] = um
+		out = append(out, um.node)
+	}
+	doc.members = members
+	if len(out) == 0 {
+		return ast, nil
+	}
+	ast, _ = nodes.Apply(ast, func(n nodes.Node) (nodes.Node, bool) {
+		obj, ok := n.(nodes.Object)
+		if !ok {
+			return n, false
+		}
+		if typ := uast.TypeOf(obj); typ != typeMemberRef && !strings.HasSuffix(typ, ":"+typeMemberRef) {
+			return n, false
+		}
+		i, _ := intValue(obj["Index"])
+		return out[i], true
+	})
+	return ast, nil
+}
+
+// memberRef is a member that is transformed separately from the rest of the native AST.
+type memberRef struct {
+	span span
+	node nodes.Object
+}
+
+// memberSplitter replaces members of the native AST that can be transformed separately with references.
+type memberSplitter struct {
+	diags []span                 // spans of diagnostics
+	known map[span]*uastMember   // members transformed previously
+	pos   map[span]uast.Position // start positions of members that can be transformed separately
+	refs  []memberRef
+}
+
+func newMemberSplitter(src string, root nodes.Object, known map[span]*uastMember) *memberSplitter {
+	sp := &memberSplitter{known: known}
+	arr, _ := root[keyDiagnostics].(nodes.Array)
+	for _, d := range arr {
+		obj, _ := d.(nodes.Object)
+		if s, ok := spanOf(obj, "Span"); ok {
+			sp.diags = append(sp.diags, s)
+		}
+	}
+	var (
+		spans []span
+		offs  []int
+	)
+	walkMembers(root, func(m nodes.Object) {
+		if s, ok := sp.separable(m); ok {
+			spans = append(spans, s)
+			offs = append(offs, int(s.start))
+		}
+	})
+	pos := utf16Positions(src, offs)
+	sp.pos = make(map[span]uast.Position, len(spans))
+	for _, s := range spans {
+		// members must start on a new line, otherwise columns of their nodes may change
+		if p := pos[int(s.start)]; p.Col == 1 {
+			sp.pos[s] = p
+		}
+	}
+	return sp
+}
+
+// walkMembers calls fnc for all members of namespaces and types that are not containers of other members.
+func walkMembers(n nodes.Object, fnc func(m nodes.Object)) {
+	members, _ := n["Members"].(nodes.Array)
+	for _, m := range members {
+		if m, ok := m.(nodes.Object); ok {
+			if isMembersContainer(m) {
+				walkMembers(m, fnc)
+			} else {
+				fnc(m)
+			}
+		}
+	}
+}
+
+// isMembersContainer checks if members of the native node can be reused by the native parser.
+// Enum members are never reused, thus enums are transformed as a whole.
+func isMembersContainer(n nodes.Object) bool {
+	_, ok := n["Members"].(nodes.Array)
+	return ok && uast.TypeOf(n) != "EnumDeclaration"
+}
+
+// separable checks if the member can be transformed separately from the rest of the AST.
+//
+// Transformations that match syntax errors with nodes and pair preprocessor directives see the whole AST.
+// Thus, members with diagnostics and directives are transformed with the rest of the AST.
+func (sp *memberSplitter) separable(m nodes.Object) (span, bool) {
+	s, ok := spanOf(m, "FullSpan")
+	if !ok || s.start == s.end {
+		return span{}, false
+	}
+	for _, d := range sp.diags {
+		if d.start <= s.end && d.end >= s.start {
+			return span{}, false
+		}
+	}
+	if _, ok := sp.known[s]; ok {
+		// it was already checked, and reused members are the same
+		return s, true
+	}
+	return s, !hasDirectives(m)
+}
+
+// split returns a copy of the native node with members replaced by references.
+// It returns false, if the node has no members that can be transformed separately.
+func (sp *memberSplitter) split(n nodes.Object) (nodes.Object, bool) {
+	members, ok := n["Members"].(nodes.Array)
+	if !ok {
+		return n, false
+	}
+	var out nodes.Array
+	for i, m := range members {
+		obj, ok := m.(nodes.Object)
+		if !ok {
+			continue
+		}
+		var ref nodes.Node
+		if isMembersContainer(obj) {
+			if sub, ok := sp.split(obj); ok {
+				ref = sub
+			}
+		} else if s, ok := spanOf(obj, "FullSpan"); ok {
+			if _, ok = sp.pos[s]; ok {
+				ref = nodes.Object{
+					uast.KeyType: nodes.String(typeMemberRef),
+					"Index":      nodes.Int(len(sp.refs)),
+				}
+				sp.refs = append(sp.refs, memberRef{span: s, node: obj})
+			}
+		}
+		if ref == nil {
+			continue
+		}
+		if out == nil {
+			out = members.CloneList()
+		}
+		out[i] = ref
+	}
+	if out == nil {
+		return n, false
+	}
+	n = n.CloneObject()
+	n["Members"] = out
+	return n, true
+}
+
+// hasDirectives checks if the native node has preprocessor directives or disabled text.
+func hasDirectives(n nodes.Node) bool {
+	found := false
+	nodes.WalkPreOrder(n, func(n nodes.Node) bool {
+		if found {
+			return false
+		}
+		typ := uast.TypeOf(n)
+		if strings.HasSuffix(typ, "DirectiveTrivia") || typ == "DisabledTextTrivia" {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// canMove checks if the transformed member can be moved to a new position by shifting its positions.
+func canMove(old, pos uast.Position) bool {
+	if old == pos {
+		return true
+	}
+	// positions of optional tokens are zero (see shiftSpans), and can't be told from positions
+	// of a member at the start of the file
+	return old.Offset != 0 && old.Col == 1 && pos.Col == 1
+}
+
+// moveMembers updates spans of transformed members reused in the new native AST.
+// Other members are dropped.
+func moveMembers(members map[span]*uastMember, reused []reusedMember) map[span]*uastMember {
+	if len(members) == 0 || len(reused) == 0 {
+		return nil
+	}
+	sort.Slice(reused, func(i, j int) bool {
+		return reused[i].old.start < reused[j].old.start
+	})
+	out := make(map[span]*uastMember)
+	for s, m := range members {
+		// members may be nested into a reused type
+		i := sort.Search(len(reused), func(i int) bool {
+			return reused[i].old.end >= s.end
+		})
+		if i == len(reused) || reused[i].old.start > s.start {
+			continue
+		}
+		shift := reused[i].shift
+		out[span{start: s.start + shift, end: s.end + shift}] = m
+	}
+	return out
+}
+
+// shiftPositions returns a copy of UAST with all positions shifted by given offset and number of lines.
+// Zero positions are not changed.
+func shiftPositions(n nodes.Node, offset, lines int64) nodes.Node {
+	if offset == 0 && lines == 0 {
+		return n
+	}
+	out, _ := nodes.Apply(n, func(n nodes.Node) (nodes.Node, bool) {
+		obj, ok := n.(nodes.Object)
+		if !ok || uast.TypeOf(obj) != uast.TypePosition {
+			return n, false
+		}
+		off, _ := intValue(obj[uast.KeyPosOff])
+		if off == 0 {
+			return n, false
+		}
+		line, _ := intValue(obj[uast.KeyPosLine])
+		obj = obj.CloneObject()
+		obj[uast.KeyPosOff] = nodes.Uint(off + offset)
+		obj[uast.KeyPosLine] = nodes.Uint(line + lines)
+		return obj, true
+	})
+	return out
+}
@@ -0,0 +1,317 @@
+package impl
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+)
+
+// envWireFormat is the name of an environment variable with the default wire format.
+const envWireFormat = "CSHARP_DRIVER_WIRE_FORMAT"
+
+// WireFormat is an encoding of responses sent by the native parser.
+type WireFormat string
+
+const (
+	// WireJSON encodes each response as a single JSON line. It's the default format.
+	WireJSON = WireFormat("json")
+	// WireMsgpack encodes each response with MessagePack, prefixed with the 32 bit length.
+	//
+	// It's more compact than JSON and is faster to decode on big files.
+	WireMsgpack = WireFormat("msgpack")
+)
+
+// handshake is a request that selects the wire format and the AST schema of the native parser.
+type handshake struct {
+	Format WireFormat `json:"format,omitempty"`
+	Schema Schema     `json:"schema,omitempty"`
+}
+
+// negotiate asks the native parser to switch to a given wire format and the AST schema.
+// Empty values keep the current settings. The response to the handshake is always sent in JSON.
+func (d *Driver) negotiate(format WireFormat, schema Schema) error {
+	if err := d.enc.Encode(&handshake{Format: format, Schema: schema}); err != nil {
+		return err
+	}
+	var r parseResponse
+	if err := d.dec.Decode(&r); err != nil {
+		return err
+	}
+	if r.Status != "ok" {
+		return fmt.Errorf("cannot switch to %q wire format and %q schema: %s", format, schema, strings.Join(r.Errors, "; "))
+	}
+	if r.Format != format {
+		return fmt.Errorf("native parser switched to an unexpected wire format: %q", r.Format)
+	}
+	if r.Schema != schema {
+		return fmt.Errorf("native parser switched to an unexpected schema: %q", r.Schema)
+	}
+	if format == WireMsgpack {
+		d.dec = &msgpackDecoder{r: d.lines}
+	}
+	return nil
+}
+
+// msgpackDecoder reads responses of the native parser in MessagePack format.
+type msgpackDecoder struct {
+	r   *lineReader
+	buf []byte
+}
+
+// Decode implements jsonlines.Decoder. It only accepts parseResponse.
+func (d *msgpackDecoder) Decode(v interface{}) error {
+	r, ok := v.(*parseResponse)
+	if !ok {
+		return fmt.Errorf("unsupported response type: %T", v)
+	}
+	var hdr [4]byte
+	if _, err := io.ReadFull(d.r, hdr[:]); err == io.ErrUnexpectedEOF {
+		return io.EOF
+	} else if err != nil {
+		return err
+	}
+	n := int(binary.BigEndian.Uint32(hdr[:]))
+	if d.r.max > 0 && n > d.r.max {
+		return ErrTooLarge.New(d.r.max)
+	}
+	if cap(d.buf) < n {
+		d.buf = make([]byte, n)
+	}
+	data := d.buf[:n]
+	if _, err := io.ReadFull(d.r, data); err == io.ErrUnexpectedEOF {
+		return io.EOF
+	} else if err != nil {
+		return err
+	}
+	d.r.last = n
+	m := msgpackReader{data: data, strs: make(map[string]string)}
+	resp, err := m.node()
+	if err != nil {
+		return err
+	}
+	obj, ok := resp.(nodes.Object)
+	if !ok {
+		return fmt.Errorf("expected an object, got: %T", resp)
+	}
+	return r.fromObject(obj)
+}
+
+// fromObject fills the response from a decoded MessagePack object.
+func (r *parseResponse) fromObject(obj nodes.Object) error {
+	str := func(k string) string {
+		s, _ := obj[k].(nodes.String)
+		return string(s)
+	}
+	*r = parseResponse{
+		Status:          strings.ToLower(str("status")),
+		AST:             obj["ast"],
+		LanguageVersion: str("languageVersion"),
+		Format:          WireFormat(str("format")),
+		Schema:          Schema(str("schema")),
+	}
+	r.Defaults, _ = obj["defaults"].(nodes.Object)
+	errs, _ := obj["errors"].(nodes.Array)
+	for _, e := range errs {
+		s, _ := e.(nodes.String)
+		r.Errors = append(r.Errors, string(s))
+	}
+	diags, _ := obj["diagnostics"].(nodes.Array)
+	for _, d := range diags {
+		o, ok := d.(nodes.Object)
+		if !ok {
+			return fmt.Errorf("expected an object, got: %T", d)
+		}
+		id, _ := o["id"].(nodes.String)
+		sev, _ := o["severity"].(nodes.String)
+		msg, _ := o["message"].(nodes.String)
+		start, _ := o["start"].(nodes.Int)
+		end, _ := o["end"].(nodes.Int)
+		r.Diagnostics = append(r.Diagnostics, nativeDiagnostic{
+			ID: string(id), Severity: Severity(sev), Message: string(msg),
+			Start: int(start), End: int(end),
+		})
+	}
+	return nil
+}
+
+var errShortMsgpack = errors.New("msgpack: unexpected end of data")
+
+// msgpackReader decodes MessagePack values directly to nodes.
+//
+// It only supports types produced by the native parser. Numbers are converted the same way
+// as nodes.ToNode does for JSON: floats without a fractional part become integers.
+type msgpackReader struct {
+	data []byte
+	strs map[string]string // interned strings
+}
+
+func (m *msgpackReader) next(n int) ([]byte, error) {
+	if len(m.data) < n {
+		return nil, errShortMsgpack
+	}
+	b := m.data[:n]
+	m.data = m.data[n:]
+	return b, nil
+}
+
+func (m *msgpackReader) uint(n int) (uint64, error) {
+	b, err := m.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (m *msgpackReader) node() (nodes.Node, error) {
+	b, err := m.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f: // positive fixint
+		return nodes.Int(c), nil
+	case c >= 0xe0: // negative fixint
+		return nodes.Int(int8(c)), nil
+	case c&0xf0 == 0x80: // fixmap
+		return m.object(int(c & 0x0f))
+	case c&0xf0 == 0x90: // fixarray
+		return m.array(int(c & 0x0f))
+	case c&0xe0 == 0xa0: // fixstr
+		return m.str(int(c & 0x1f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return nodes.Bool(false), nil
+	case 0xc3:
+		return nodes.Bool(true), nil
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8-64
+		v, err := m.uint(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if v > math.MaxInt64 {
+			return nodes.Float(v), nil
+		}
+		return nodes.Int(v), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int 8-64
+		n := 1 << (c - 0xd0)
+		v, err := m.uint(n)
+		if err != nil {
+			return nil, err
+		}
+		// sign-extend
+		shift := uint(64 - 8*n)
+		return nodes.Int(int64(v<<shift) >> shift), nil
+	case 0xca:
+		v, err := m.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float(float64(math.Float32frombits(uint32(v)))), nil
+	case 0xcb:
+		v, err := m.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return float(math.Float64frombits(v)), nil
+	case 0xd9, 0xda, 0xdb: // str 8-32
+		n, err := m.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return m.str(int(n))
+	case 0xdc, 0xdd: // array 16-32
+		n, err := m.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return m.array(int(n))
+	case 0xde, 0xdf: // map 16-32
+		n, err := m.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return m.object(int(n))
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type: 0x%x", c)
+}
+
+// float converts a floating point number to a node the same way nodes.ToNode does.
+func float(v float64) nodes.Node {
+	if float64(int64(v)) != v {
+		return nodes.Float(v)
+	}
+	return nodes.Int(v)
+}
+
+// maxInterned is the maximal length of strings that are interned during decoding.
+// Short strings, like node types, field names and punctuation, are repeated a lot in the AST.
+const maxInterned = 32
+
+func (m *msgpackReader) str(n int) (nodes.Node, error) {
+	b, err := m.next(n)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxInterned {
+		return nodes.String(b), nil
+	}
+	s, ok := m.strs[string(b)]
+	if !ok {
+		s = string(b)
+		m.strs[s] = s
+	}
+	return nodes.String(s), nil
+}
+
+func (m *msgpackReader) array(n int) (nodes.Node, error) {
+	if n > len(m.data) {
+		// each element takes at least one byte
+		return nil, errShortMsgpack
+	}
+	arr := make(nodes.Array, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := m.node()
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+	}
+	return arr, nil
+}
+
+func (m *msgpackReader) object(n int) (nodes.Node, error) {
+	if 2*n > len(m.data) {
+		// each key and value takes at least one byte
+		return nil, errShortMsgpack
+	}
+	obj := make(nodes.Object, n)
+	for i := 0; i < n; i++ {
+		k, err := m.node()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(nodes.String)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: expected a string key, got: %T", k)
+		}
+		v, err := m.node()
+		if err != nil {
+			return nil, err
+		}
+		obj[string(key)] = v
+	}
+	return obj, nil
+}
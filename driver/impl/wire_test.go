@@ -0,0 +1,266 @@
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+)
+
+// msgpack helpers that build encoded values for tests
+
+func mpUint(typ byte, n int, v uint64) []byte {
+	b := make([]byte, 1+n)
+	b[0] = typ
+	for i := n; i > 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+	return b
+}
+
+func mpStr(s string) []byte {
+	var hdr []byte
+	switch n := len(s); {
+	case n < 32:
+		hdr = []byte{0xa0 | byte(n)}
+	case n <= math.MaxUint8:
+		hdr = mpUint(0xd9, 1, uint64(n))
+	case n <= math.MaxUint16:
+		hdr = mpUint(0xda, 2, uint64(n))
+	default:
+		hdr = mpUint(0xdb, 4, uint64(n))
+	}
+	return append(hdr, s...)
+}
+
+func mpConcat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// mpMap encodes a map with n integer values using the given header.
+func mpMap(hdr []byte, n int) ([]byte, nodes.Object) {
+	data := append([]byte{}, hdr...)
+	obj := make(nodes.Object, n)
+	for i := 0; i < n; i++ {
+		k := "k" + strconv.Itoa(i)
+		data = append(data, mpStr(k)...)
+		data = append(data, mpUint(0xcd, 2, uint64(i))...)
+		obj[k] = nodes.Int(i)
+	}
+	return data, obj
+}
+
+var msgpackCases = func() []struct {
+	name string
+	data []byte
+	exp  nodes.Node
+} {
+	type testCase = struct {
+		name string
+		data []byte
+		exp  nodes.Node
+	}
+	str8 := strings.Repeat("a", 200)
+	str16 := strings.Repeat("b", 1000)
+	str32 := strings.Repeat("c", math.MaxUint16+1)
+
+	map16, obj16 := mpMap(mpUint(0xde, 2, 20), 20)
+	map32, obj32 := mpMap(mpUint(0xdf, 4, 3), 3)
+
+	arr16 := mpUint(0xdc, 2, 17)
+	arr16Exp := make(nodes.Array, 0, 17)
+	for i := 0; i < 17; i++ {
+		arr16 = append(arr16, byte(i))
+		arr16Exp = append(arr16Exp, nodes.Int(i))
+	}
+
+	return []testCase{
+		{name: "nil", data: []byte{0xc0}, exp: nil},
+		{name: "false", data: []byte{0xc2}, exp: nodes.Bool(false)},
+		{name: "true", data: []byte{0xc3}, exp: nodes.Bool(true)},
+
+		{name: "positive fixint", data: []byte{0x7f}, exp: nodes.Int(127)},
+		{name: "negative fixint", data: []byte{0xe0}, exp: nodes.Int(-32)},
+		{name: "uint8", data: mpUint(0xcc, 1, 200), exp: nodes.Int(200)},
+		{name: "uint16", data: mpUint(0xcd, 2, 60000), exp: nodes.Int(60000)},
+		{name: "uint32", data: mpUint(0xce, 4, 4000000000), exp: nodes.Int(4000000000)},
+		{name: "uint64", data: mpUint(0xcf, 8, 1<<40), exp: nodes.Int(1 << 40)},
+		{name: "uint64 overflow", data: mpUint(0xcf, 8, math.MaxUint64), exp: nodes.Float(math.MaxUint64)},
+		{name: "int8", data: mpUint(0xd0, 1, 0x80), exp: nodes.Int(math.MinInt8)},
+		{name: "int16", data: mpUint(0xd1, 2, 0xfffe), exp: nodes.Int(-2)},
+		{name: "int32", data: mpUint(0xd2, 4, 0x80000000), exp: nodes.Int(math.MinInt32)},
+		{name: "int64", data: mpUint(0xd3, 8, math.MaxUint64), exp: nodes.Int(-1)},
+		{name: "int64 positive", data: mpUint(0xd3, 8, math.MaxInt64), exp: nodes.Int(math.MaxInt64)},
+		{name: "float32", data: mpUint(0xca, 4, uint64(math.Float32bits(1.5))), exp: nodes.Float(1.5)},
+		{name: "float32 integer", data: mpUint(0xca, 4, uint64(math.Float32bits(-3))), exp: nodes.Int(-3)},
+		{name: "float64", data: mpUint(0xcb, 8, math.Float64bits(0.25)), exp: nodes.Float(0.25)},
+		{name: "float64 integer", data: mpUint(0xcb, 8, math.Float64bits(42)), exp: nodes.Int(42)},
+
+		{name: "empty fixstr", data: []byte{0xa0}, exp: nodes.String("")},
+		{name: "fixstr", data: mpStr("Token"), exp: nodes.String("Token")},
+		{name: "str8", data: mpStr(str8), exp: nodes.String(str8)},
+		{name: "str16", data: mpStr(str16), exp: nodes.String(str16)},
+		{name: "str32", data: mpStr(str32), exp: nodes.String(str32)},
+
+		{name: "empty fixarray", data: []byte{0x90}, exp: nodes.Array{}},
+		{
+			name: "fixarray",
+			data: mpConcat([]byte{0x93, 0x01, 0xc0}, mpStr("x"), nil),
+			exp:  nodes.Array{nodes.Int(1), nil, nodes.String("x")},
+		},
+		{name: "array16", data: arr16, exp: arr16Exp},
+		{
+			name: "array32",
+			data: mpConcat(mpUint(0xdd, 4, 2), []byte{0xc3, 0x90}),
+			exp:  nodes.Array{nodes.Bool(true), nodes.Array{}},
+		},
+
+		{name: "empty fixmap", data: []byte{0x80}, exp: nodes.Object{}},
+		{
+			name: "fixmap",
+			data: mpConcat([]byte{0x82}, mpStr("@type"), mpStr("Block"), mpStr("Statements"), []byte{0x91, 0x80}),
+			exp: nodes.Object{
+				"@type":      nodes.String("Block"),
+				"Statements": nodes.Array{nodes.Object{}},
+			},
+		},
+		{name: "map16", data: map16, exp: obj16},
+		{name: "map32", data: map32, exp: obj32},
+	}
+}()
+
+func TestMsgpackReader(t *testing.T) {
+	for _, c := range msgpackCases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			m := msgpackReader{data: c.data, strs: make(map[string]string)}
+			got, err := m.node()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(c.exp, got) {
+				t.Fatalf("unexpected value:\n%#v\nvs\n%#v", c.exp, got)
+			}
+			if len(m.data) != 0 {
+				t.Fatalf("%d bytes left", len(m.data))
+			}
+		})
+	}
+}
+
+func TestMsgpackReaderTruncated(t *testing.T) {
+	for _, c := range msgpackCases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			for n := 0; n < len(c.data); n++ {
+				m := msgpackReader{data: c.data[:n], strs: make(map[string]string)}
+				if _, err := m.node(); err != errShortMsgpack {
+					t.Fatalf("expected an error for %d of %d bytes, got: %v", n, len(c.data), err)
+				}
+			}
+		})
+	}
+}
+
+func TestMsgpackReaderErrors(t *testing.T) {
+	for _, data := range [][]byte{
+		{0xc1},                   // never used
+		{0xc4, 0x00},             // bin 8
+		{0x81, 0x01, 0x02},       // non-string key
+		{0x91, 0xd4, 0x00, 0x00}, // fixext 1
+	} {
+		m := msgpackReader{data: data, strs: make(map[string]string)}
+		if _, err := m.node(); err == nil || err == errShortMsgpack {
+			t.Fatalf("expected an error for % x, got: %v", data, err)
+		}
+	}
+}
+
+func TestMsgpackReaderInterning(t *testing.T) {
+	m := msgpackReader{data: mpConcat([]byte{0x92}, mpStr("IdentifierToken"), mpStr("IdentifierToken")), strs: make(map[string]string)}
+	v, err := m.node()
+	if err != nil {
+		t.Fatal(err)
+	}
+	arr := v.(nodes.Array)
+	s1, s2 := string(arr[0].(nodes.String)), string(arr[1].(nodes.String))
+	if s1 != "IdentifierToken" || s2 != s1 {
+		t.Fatalf("unexpected values: %q, %q", s1, s2)
+	}
+	if len(m.strs) != 1 {
+		t.Fatalf("expected a single interned string, got %d", len(m.strs))
+	}
+}
+
+// msgpackFrame prefixes the encoded value with its length, as the native parser does.
+func msgpackFrame(data []byte) []byte {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(data)))
+	return append(hdr[:], data...)
+}
+
+func newMsgpackDecoder(data []byte, max int) *msgpackDecoder {
+	return &msgpackDecoder{r: &lineReader{r: bufio.NewReader(bytes.NewReader(data)), max: max}}
+}
+
+func TestMsgpackDecoder(t *testing.T) {
+	resp := mpConcat(
+		[]byte{0x84},
+		mpStr("status"), mpStr("Ok"),
+		mpStr("ast"), []byte{0x81}, mpStr("@type"), mpStr("CompilationUnit"),
+		mpStr("languageVersion"), mpStr("7.3"),
+		mpStr("diagnostics"), []byte{0x91, 0x85},
+		mpStr("id"), mpStr("CS1002"),
+		mpStr("severity"), mpStr("Error"),
+		mpStr("message"), mpStr("; expected"),
+		mpStr("start"), []byte{0x05},
+		mpStr("end"), []byte{0x05},
+	)
+	stream := mpConcat(msgpackFrame(resp), msgpackFrame(resp))
+	dec := newMsgpackDecoder(stream, 0)
+	exp := parseResponse{
+		Status:          "ok",
+		AST:             nodes.Object{"@type": nodes.String("CompilationUnit")},
+		LanguageVersion: "7.3",
+		Diagnostics: []nativeDiagnostic{
+			{ID: "CS1002", Severity: SeverityError, Message: "; expected", Start: 5, End: 5},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		var r parseResponse
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(exp, r) {
+			t.Fatalf("unexpected response:\n%#v\nvs\n%#v", exp, r)
+		}
+	}
+	var r parseResponse
+	if err := dec.Decode(&r); err != io.EOF {
+		t.Fatalf("expected EOF, got: %v", err)
+	}
+
+	// truncated frames are reported as EOF, since the parser has crashed
+	for _, n := range []int{1, 3, 4, len(resp)} {
+		var r parseResponse
+		if err := newMsgpackDecoder(msgpackFrame(resp)[:n], 0).Decode(&r); err != io.EOF {
+			t.Fatalf("expected EOF for %d bytes, got: %v", n, err)
+		}
+	}
+
+	// the size limit is checked before reading the frame
+	if err := newMsgpackDecoder(msgpackFrame(resp), len(resp)-1).Decode(&r); !ErrTooLarge.Is(err) {
+		t.Fatalf("expected a size limit error, got: %v", err)
+	}
+	if err := newMsgpackDecoder(msgpackFrame(resp), len(resp)).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -33,8 +33,12 @@ var PreprocessCode = []CodeTransformer{
 			"SingleLineCommentTrivia",
 			"SingleLineDocumentationCommentTrivia",
 			"MultiLineCommentTrivia",
+			"MultiLineDocumentationCommentTrivia",
 		},
 	},
+	positioner.TokenFromSource{
+		Types: directiveTypeNames(),
+	},
 }
 
 // Annotations is a list of individual transformations to annotate a native AST with roles.
@@ -42,6 +46,9 @@ var Annotations = []Mapping{
 
 	// Misc
 	AnnotateType("CompilationUnit", nil, role.File, role.Module),
+	AnnotateType("ParseVariant", nil, role.Module, role.Incomplete),
+	// syntax errors and warnings reported by the parser
+	AnnotateType("Diagnostic", nil, role.Incomplete),
 	AnnotateType("Block", nil, role.Block),
 	AnnotateType("LockStatement", nil, role.Statement, role.Block, role.Incomplete),
 	AnnotateType("CheckedStatement_UncheckedStatement", nil, role.Block, role.Statement, role.Incomplete),
@@ -76,6 +83,7 @@ var Annotations = []Mapping{
 	AnnotateType("MemberBindingExpression", nil, role.Expression, role.Qualified),
 	AnnotateType("IncompleteMember", nil, role.Function, role.Incomplete),
 	AnnotateType("SkippedTokensTrivia", nil, role.Incomplete),
+	AnnotateType(typeMissingNode, nil, role.Incomplete),
 	AnnotateType("AttributeList", nil, role.List, role.Incomplete),
 	AnnotateType("AttributeArgumentList", nil, role.List, role.Argument, role.Incomplete),
 	AnnotateType("Attribute", nil, role.Incomplete),
@@ -407,13 +415,18 @@ var Annotations = []Mapping{
 	AnnotateType("StructDeclaration", nil, role.Type, role.Declaration),
 	AnnotateType("EnumDeclaration", nil, role.Type, role.Declaration, role.Enumeration),
 	AnnotateType("EnumMemberDeclaration", nil, role.Type, role.Declaration, role.Enumeration, role.Value),
+	// semantic type declaration, see typeDefMap
+	AnnotateType("TypeDeclaration", nil, role.Type, role.Declaration),
 	AnnotateType("TupleExpression", nil, role.Value, role.List, role.Expression),
 	AnnotateType("TupleType", nil, role.Declaration, role.List, role.Expression),
 	AnnotateType("TupleElement", nil, role.List, role.Value),
 	AnnotateType("BaseConstructorInitializer", nil, role.Function, role.Declaration, role.Argument, role.Base, role.Initialization, role.Incomplete),
+	AnnotateType("ThisConstructorInitializer", nil, role.Function, role.Declaration, role.Argument, role.This, role.Initialization, role.Incomplete),
 	AnnotateType("BaseList", nil, role.Base, role.List),
 	AnnotateType("SimpleBaseType", nil, role.Base, role.Type),
 	AnnotateType("ConstructorDeclaration", nil, role.Type, role.Function, role.Declaration, role.This),
+	// semantic constructor marker, see ConstructorDeclaration in normalizer.go
+	AnnotateType("Constructor", nil, role.Function, role.Declaration, role.Initialization),
 	AnnotateType("DestructorDeclaration", nil, role.Type, role.Function, role.Declaration, role.Incomplete),
 	AnnotateType("FieldDeclaration", nil, role.Type, role.Declaration, role.Variable),
 	AnnotateType("MethodDeclaration", nil, role.Type, role.Function, role.Declaration),
@@ -432,6 +445,11 @@ var Annotations = []Mapping{
 	AnnotateType("TypeConstraint", nil, role.Function, role.Declaration, role.Argument, role.Condition, role.Type, role.Name, role.Incomplete),
 	AnnotateType("ObjectInitializerExpression", nil, role.Type, role.Instance, role.Call, role.Block),
 	AnnotateType("PropertyDeclaration", nil, role.Function, role.Value, role.Declaration, role.Incomplete),
+	// semantic property declaration, see propertyDefMap
+	AnnotateType("Property", nil, role.Function, role.Value, role.Declaration),
+	// semantic indexer and event declarations, see indexerDefMap and eventDefMap
+	AnnotateType("Indexer", nil, role.Function, role.Declaration, role.List),
+	AnnotateType("Event", nil, role.Declaration, role.Variable),
 	AnnotateType("AccessorList", nil, role.List, role.Function, role.Declaration, role.Incomplete),
 	AnnotateType("AddAccessorDeclaration", nil, role.Function, role.Declaration, role.Value, role.Incomplete),
 	AnnotateType("RemoveAccessorDeclaration", nil, role.Function, role.Declaration, role.Value, role.Incomplete),
@@ -444,9 +462,12 @@ var Annotations = []Mapping{
 	AnnotateType("IndexerDeclaration", nil, role.Function, role.Declaration, role.List, role.Incomplete),
 	// indexer declaration [arguments]
 	AnnotateType("BracketedParameterList", nil, role.Function, role.Declaration, role.List, role.Argument),
+	AnnotateType("OperatorDeclaration", nil, role.Function, role.Declaration, role.Operator),
 	AnnotateType("ConversionOperatorDeclaration", nil, role.Function, role.Declaration, role.Operator),
 	AnnotateType("DelegateDeclaration", nil, role.Function, role.Declaration, role.Incomplete),
 	AnnotateType("RefType", nil, role.Argument, role.Incomplete),
+	// semantic by-reference parameter type, see opByRefModifiers
+	AnnotateType("ByRefType", nil, role.Argument, role.Type),
 	AnnotateType("LiteralExpression_ArgListExpression", nil, role.ArgsList),
 
 	// Flow control
@@ -491,9 +512,15 @@ var Annotations = []Mapping{
 	AnnotateType("DefineDirectiveTrivia", nil, role.Declaration, role.Value, role.Incomplete),
 	AnnotateType("UndefDirectiveTrivia", nil, role.Declaration, role.Value, role.Incomplete),
 	AnnotateType("DisabledTextTrivia", nil, role.Noop, role.Incomplete),
+	AnnotateType("ConditionalDirective", nil, role.If, role.Block, role.Incomplete),
+	AnnotateType("ConditionalBranch", nil, role.Block, role.Incomplete),
+	AnnotateType("Region", nil, role.Block, role.Incomplete),
 
 	// Comments
 	AnnotateType("SingleLineCommentTrivia", nil, role.Comment, role.Noop),
 	AnnotateType("SingleLineDocumentationCommentTrivia", nil, role.Comment, role.Noop, role.Documentation),
+	// semantic documentation comment, see opDocComment
+	AnnotateType("Documentation", nil, role.Comment, role.Noop, role.Documentation),
 	AnnotateType("MultiLineCommentTrivia", nil, role.Comment, role.Noop),
+	AnnotateType("MultiLineDocumentationCommentTrivia", nil, role.Comment, role.Noop, role.Documentation),
 }
@@ -0,0 +1,576 @@
+package normalizer
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	. "github.com/bblfsh/sdk/v3/uast/transformer"
+)
+
+const (
+	// typeConditional is a type of the node that describes a single #if ... #endif
+	// directive chain in Semantic mode.
+	typeConditional = "ConditionalDirective"
+	// typeBranch is a type of the node that describes a single branch of the #if chain.
+	typeBranch = "ConditionalBranch"
+	// typeRegion is a type of the node that describes a #region ... #endregion pair.
+	typeRegion = "Region"
+)
+
+// directiveTypes is a list of preprocessor directive trivias and the disabled text trivia.
+//
+// Trivia structure is not serialized by the native driver, thus we take the text of the
+// directive from the source code and parse it on our side (see pairDirectives).
+var directiveTypes = []nodes.Value{
+	nodes.String("IfDirectiveTrivia"),
+	nodes.String("ElifDirectiveTrivia"),
+	nodes.String("ElseDirectiveTrivia"),
+	nodes.String("EndIfDirectiveTrivia"),
+	nodes.String("RegionDirectiveTrivia"),
+	nodes.String("EndRegionDirectiveTrivia"),
+	nodes.String("DefineDirectiveTrivia"),
+	nodes.String("UndefDirectiveTrivia"),
+	nodes.String("PragmaWarningDirectiveTrivia"),
+	nodes.String("PragmaChecksumDirectiveTrivia"),
+	nodes.String("LineDirectiveTrivia"),
+	nodes.String("WarningDirectiveTrivia"),
+	nodes.String("ErrorDirectiveTrivia"),
+	nodes.String("DisabledTextTrivia"),
+}
+
+// directiveTypeNames returns the list of directive types as strings.
+func directiveTypeNames() []string {
+	out := make([]string, 0, len(directiveTypes))
+	for _, v := range directiveTypes {
+		out = append(out, string(v.(nodes.String)))
+	}
+	return out
+}
+
+// directive is a preprocessor directive or a disabled text trivia found in the tree.
+type directive struct {
+	typ   string
+	text  string
+	start uast.Position
+	end   uast.Position
+
+	fields nodes.Object // fields that will be added to the node
+}
+
+// conditional is a chain of #if, #elif, #else and #endif directives.
+type conditional struct {
+	node     nodes.Object
+	start    uast.Position
+	branches nodes.Array
+	last     *directive // the directive that started the last branch
+}
+
+// region is a #region directive with an optional matching #endregion.
+type region struct {
+	node  nodes.Object
+	start uast.Position
+}
+
+var _ Transformer = pairDirectives{}
+
+// pairDirectives is a transformation that pairs conditional and region directives.
+//
+// Directives are trivia, thus opMoveTrivias scatters them all over the tree. This transform
+// collects them in the source order and:
+//
+//   - pairs #if with its #elif, #else and #endif, and #region with #endregion;
+//   - parses conditions of #if and #elif to an expression tree (Condition field);
+//   - sets Conditional and Branch indexes on each directive and on the disabled text,
+//     and the Region index on region directives;
+//   - sets the Symbol field of #define and #undef and the Action and Warnings fields
+//     of #pragma warning;
+//   - adds the list of all conditionals (Conditionals field) and regions (Regions field)
+//     to the root node. Each conditional branch has positional info that covers the code
+//     guarded by it, see ConditionalBranchOf.
+//
+// Directives dropped by previous transformations cannot be paired, thus the chain may
+// miss some branches or the #endif.
+type pairDirectives struct{}
+
+func (pairDirectives) Do(root nodes.Node) (nodes.Node, error) {
+	obj, ok := root.(nodes.Object)
+	if !ok {
+		return root, nil
+	}
+	dirs := collectDirectives(obj)
+	if len(dirs) == 0 {
+		return root, nil
+	}
+	conds, regions := matchDirectives(dirs)
+
+	byOffset := make(map[uint32]*directive, len(dirs))
+	for _, d := range dirs {
+		if len(d.fields) != 0 {
+			byOffset[d.start.Offset] = d
+		}
+	}
+	out, _ := nodes.Apply(obj, func(n nodes.Node) (nodes.Node, bool) {
+		o, ok := n.(nodes.Object)
+		if !ok || !isDirective(o) {
+			return n, false
+		}
+		start := uast.PositionsOf(o).Start()
+		if start == nil {
+			return n, false
+		}
+		d, ok := byOffset[start.Offset]
+		if !ok || d.typ != uast.TypeOf(o) {
+			return n, false
+		}
+		o = o.CloneObject()
+		for k, v := range d.fields {
+			o[k] = v
+		}
+		return o, true
+	})
+	obj, ok = out.(nodes.Object)
+	if !ok {
+		return out, nil
+	}
+	obj = obj.CloneObject()
+	obj["Conditionals"] = conds
+	obj["Regions"] = regions
+	return obj, nil
+}
+
+// isDirective checks if the node is a directive trivia.
+func isDirective(n nodes.Object) bool {
+	typ, ok := n[uast.KeyType].(nodes.String)
+	if !ok {
+		return false
+	}
+	for _, v := range directiveTypes {
+		if typ == v {
+			return true
+		}
+	}
+	return false
+}
+
+// collectDirectives returns all directives found in the tree, sorted by their position.
+//
+// The same directive may appear multiple times if the file was parsed with multiple symbol
+// sets (see ParseVariant). Only the first one is returned.
+func collectDirectives(root nodes.Node) []*directive {
+	type key struct {
+		typ string
+		off uint32
+	}
+	var dirs []*directive
+	seen := make(map[key]bool)
+	nodes.WalkPreOrder(root, func(n nodes.Node) bool {
+		obj, ok := n.(nodes.Object)
+		if !ok || !isDirective(obj) {
+			return true
+		}
+		pos := uast.PositionsOf(obj)
+		start, end := pos.Start(), pos.End()
+		if start == nil || end == nil {
+			return false
+		}
+		k := key{typ: uast.TypeOf(obj), off: start.Offset}
+		if seen[k] {
+			return false
+		}
+		seen[k] = true
+		text, _ := obj[uast.KeyToken].(nodes.String)
+		dirs = append(dirs, &directive{
+			typ:   uast.TypeOf(obj),
+			text:  string(text),
+			start: *start,
+			end:   *end,
+		})
+		return false
+	})
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return dirs[i].start.Offset < dirs[j].start.Offset
+	})
+	return dirs
+}
+
+// matchDirectives pairs directives and sets fields that will be added to directive nodes.
+// It returns the lists of conditionals and regions that will be added to the root node.
+func matchDirectives(dirs []*directive) (nodes.Array, nodes.Array) {
+	var (
+		conds   nodes.Array
+		regions nodes.Array
+		cstack  []*conditional
+		rstack  []*region
+	)
+	addBranch := func(c *conditional, d *directive, kind string, cond nodes.Node) {
+		c.closeBranch(d.start)
+		d.fields = nodes.Object{
+			"Conditional": c.node["Id"],
+			"Branch":      nodes.Int(len(c.branches)),
+		}
+		branch := nodes.Object{
+			uast.KeyType: nodes.String(typeBranch),
+			uast.KeyPos:  positions(d.start, d.end),
+			"Kind":       nodes.String(kind),
+			"Condition":  nil,
+		}
+		if cond != nil {
+			d.fields["Condition"] = cond
+			branch["Condition"] = cond.Clone()
+		} else if kind != "else" {
+			d.fields["Condition"] = nil
+		}
+		c.branches = append(c.branches, branch)
+		c.last = d
+	}
+	for _, d := range dirs {
+		var top *conditional
+		if len(cstack) != 0 {
+			top = cstack[len(cstack)-1]
+		}
+		args := directiveArgs(d.text)
+		switch d.typ {
+		case "IfDirectiveTrivia":
+			c := &conditional{
+				node: nodes.Object{
+					uast.KeyType: nodes.String(typeConditional),
+					"Id":         nodes.Int(len(conds)),
+				},
+				start: d.start,
+			}
+			conds = append(conds, c.node)
+			cstack = append(cstack, c)
+			addBranch(c, d, "if", parseDirectiveCond(args, d.start))
+		case "ElifDirectiveTrivia":
+			if top != nil {
+				addBranch(top, d, "elif", parseDirectiveCond(args, d.start))
+			}
+		case "ElseDirectiveTrivia":
+			if top != nil {
+				addBranch(top, d, "else", nil)
+			}
+		case "EndIfDirectiveTrivia":
+			if top == nil {
+				continue
+			}
+			top.closeBranch(d.start)
+			top.finish(d.end)
+			d.fields = nodes.Object{"Conditional": top.node["Id"]}
+			cstack = cstack[:len(cstack)-1]
+		case "DisabledTextTrivia":
+			if top != nil {
+				d.fields = nodes.Object{
+					"Conditional": top.node["Id"],
+					"Branch":      nodes.Int(len(top.branches) - 1),
+				}
+			}
+		case "RegionDirectiveTrivia":
+			r := &region{
+				node: nodes.Object{
+					uast.KeyType: nodes.String(typeRegion),
+					uast.KeyPos:  positions(d.start, d.end),
+					"Id":         nodes.Int(len(regions)),
+					"Name":       nodes.String(strings.TrimSpace(args.text)),
+				},
+				start: d.start,
+			}
+			regions = append(regions, r.node)
+			rstack = append(rstack, r)
+			d.fields = nodes.Object{
+				"Region": r.node["Id"],
+				"Name":   r.node["Name"],
+			}
+		case "EndRegionDirectiveTrivia":
+			if len(rstack) == 0 {
+				continue
+			}
+			r := rstack[len(rstack)-1]
+			rstack = rstack[:len(rstack)-1]
+			r.node[uast.KeyPos] = positions(r.start, d.end)
+			d.fields = nodes.Object{"Region": r.node["Id"]}
+		case "DefineDirectiveTrivia", "UndefDirectiveTrivia":
+			d.fields = nodes.Object{
+				"Symbol": nodes.String(firstWord(args.text)),
+			}
+		case "PragmaWarningDirectiveTrivia":
+			// #pragma warning disable CS0168, CS0219
+			s := strings.TrimSpace(args.text)
+			if !strings.HasPrefix(s, "warning") {
+				continue
+			}
+			s = strings.TrimPrefix(s, "warning")
+			action := firstWord(s)
+			s = strings.TrimPrefix(strings.TrimSpace(s), action)
+			warns := nodes.Array{}
+			for _, w := range strings.Split(s, ",") {
+				if w = strings.TrimSpace(w); w != "" {
+					warns = append(warns, nodes.String(w))
+				}
+			}
+			d.fields = nodes.Object{
+				"Action":   nodes.String(action),
+				"Warnings": warns,
+			}
+		}
+	}
+	// conditionals without #endif end at the last branch
+	for _, c := range cstack {
+		c.closeBranch(c.last.end)
+		c.finish(c.last.end)
+	}
+	if conds == nil {
+		conds = nodes.Array{}
+	}
+	if regions == nil {
+		regions = nodes.Array{}
+	}
+	return conds, regions
+}
+
+// closeBranch sets the end position of the last branch.
+func (c *conditional) closeBranch(end uast.Position) {
+	if len(c.branches) == 0 {
+		return
+	}
+	b := c.branches[len(c.branches)-1].(nodes.Object)
+	b[uast.KeyPos] = positions(c.last.start, end)
+}
+
+// finish sets positional info and branches of the conditional node.
+func (c *conditional) finish(end uast.Position) {
+	c.node[uast.KeyPos] = positions(c.start, end)
+	c.node["Branches"] = c.branches
+}
+
+// positions creates a positional node with the given start and end positions.
+func positions(start, end uast.Position) nodes.Object {
+	return uast.Positions{
+		uast.KeyStart: start,
+		uast.KeyEnd:   end,
+	}.ToObject()
+}
+
+// firstWord returns the first whitespace-separated word of the string.
+func firstWord(s string) string {
+	f := strings.Fields(s)
+	if len(f) == 0 {
+		return ""
+	}
+	return f[0]
+}
+
+// dirArgs is the text of directive arguments and its offset in the directive.
+type dirArgs struct {
+	text string
+	off  int
+}
+
+// directiveArgs cuts the directive keyword and the trailing comment from the directive text.
+func directiveArgs(text string) dirArgs {
+	i := strings.IndexByte(text, '#')
+	if i < 0 {
+		return dirArgs{}
+	}
+	i++
+	for i < len(text) && (text[i] == ' ' || text[i] == '\t') {
+		i++
+	}
+	for i < len(text) && isIdentChar(text[i]) {
+		i++
+	}
+	s := text[i:]
+	if j := strings.Index(s, "//"); j >= 0 {
+		s = s[:j]
+	}
+	return dirArgs{text: s, off: i}
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// parseDirectiveCond parses the condition of #if and #elif directives.
+//
+// Symbols are converted to uast:Identifier, true and false to uast:Bool, and operators
+// to the same node types that Roslyn uses for C# expressions. Parentheses are dropped.
+// It returns nil if the condition cannot be parsed.
+func parseDirectiveCond(args dirArgs, start uast.Position) nodes.Node {
+	p := &condParser{s: args.text, off: args.off, start: start}
+	n := p.parseOr()
+	p.skipSpace()
+	if p.err || p.i != len(p.s) {
+		return nil
+	}
+	return n
+}
+
+// condParser is a recursive descent parser for preprocessor conditions.
+type condParser struct {
+	s     string
+	i     int
+	off   int           // offset of s in the directive text
+	start uast.Position // position of the directive
+	err   bool
+}
+
+func (p *condParser) pos(i int) uast.Position {
+	d := uint32(p.off + i)
+	return uast.Position{
+		Offset: p.start.Offset + d,
+		Line:   p.start.Line,
+		Col:    p.start.Col + d,
+	}
+}
+
+func (p *condParser) skipSpace() {
+	for p.i < len(p.s) && (p.s[p.i] == ' ' || p.s[p.i] == '\t') {
+		p.i++
+	}
+}
+
+func (p *condParser) accept(tok string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.s[p.i:], tok) {
+		p.i += len(tok)
+		return true
+	}
+	return false
+}
+
+func (p *condParser) binary(typ string, left, right nodes.Node, start int) nodes.Node {
+	if left == nil || right == nil {
+		p.err = true
+		return nil
+	}
+	return nodes.Object{
+		uast.KeyType: nodes.String(typ),
+		uast.KeyPos:  positions(p.pos(start), p.pos(p.i)),
+		"Left":       left,
+		"Right":      right,
+	}
+}
+
+func (p *condParser) parseOr() nodes.Node {
+	p.skipSpace()
+	start := p.i
+	n := p.parseAnd()
+	for !p.err && p.accept("||") {
+		n = p.binary("BinaryExpression_LogicalOrExpression", n, p.parseAnd(), start)
+	}
+	return n
+}
+
+func (p *condParser) parseAnd() nodes.Node {
+	p.skipSpace()
+	start := p.i
+	n := p.parseEq()
+	for !p.err && p.accept("&&") {
+		n = p.binary("BinaryExpression_LogicalAndExpression", n, p.parseEq(), start)
+	}
+	return n
+}
+
+func (p *condParser) parseEq() nodes.Node {
+	p.skipSpace()
+	start := p.i
+	n := p.parseUnary()
+	for !p.err {
+		if p.accept("==") {
+			n = p.binary("BinaryExpression_EqualsExpression", n, p.parseUnary(), start)
+		} else if p.accept("!=") {
+			n = p.binary("BinaryExpression_NotEqualsExpression", n, p.parseUnary(), start)
+		} else {
+			break
+		}
+	}
+	return n
+}
+
+func (p *condParser) parseUnary() nodes.Node {
+	p.skipSpace()
+	start := p.i
+	if p.accept("!") {
+		sub := p.parseUnary()
+		if sub == nil {
+			p.err = true
+			return nil
+		}
+		return nodes.Object{
+			uast.KeyType: nodes.String("PrefixUnaryExpression_LogicalNotExpression"),
+			uast.KeyPos:  positions(p.pos(start), p.pos(p.i)),
+			"Operand":    sub,
+		}
+	}
+	if p.accept("(") {
+		n := p.parseOr()
+		if !p.accept(")") {
+			p.err = true
+			return nil
+		}
+		return n
+	}
+	for p.i < len(p.s) && isIdentChar(p.s[p.i]) {
+		p.i++
+	}
+	if p.i == start {
+		p.err = true
+		return nil
+	}
+	name := p.s[start:p.i]
+	pos := positions(p.pos(start), p.pos(p.i))
+	switch name {
+	case "true", "false":
+		return nodes.Object{
+			uast.KeyType: nodes.String(uast.TypeOf(uast.Bool{})),
+			uast.KeyPos:  pos,
+			"Value":      nodes.Bool(name == "true"),
+		}
+	}
+	return nodes.Object{
+		uast.KeyType: nodes.String(uast.TypeOf(uast.Identifier{})),
+		uast.KeyPos:  pos,
+		"Name":       nodes.String(name),
+	}
+}
+
+// ConditionalBranchOf finds the innermost conditional branch that contains a given position.
+// The root must be a Semantic UAST of the file.
+//
+// It returns the conditional (ConditionalDirective node) and the index of the branch in it.
+// If the position is not guarded by any conditional directive, it returns nil.
+func ConditionalBranchOf(root nodes.Node, pos uast.Position) (nodes.Object, int) {
+	obj, ok := root.(nodes.Object)
+	if !ok {
+		return nil, -1
+	}
+	conds, _ := obj["Conditionals"].(nodes.Array)
+	var (
+		best   nodes.Object
+		branch = -1
+		from   uast.Position
+	)
+	for _, c := range conds {
+		c, ok := c.(nodes.Object)
+		if !ok {
+			continue
+		}
+		branches, _ := c["Branches"].(nodes.Array)
+		for i, b := range branches {
+			bp := uast.PositionsOf(b)
+			start, end := bp.Start(), bp.End()
+			if start == nil || end == nil {
+				continue
+			}
+			if pos.Offset < start.Offset || pos.Offset >= end.Offset {
+				continue
+			}
+			// conditionals are sorted, thus the last one that matches is the innermost
+			if best == nil || from.Offset <= start.Offset {
+				best, branch, from = c, i, *start
+			}
+		}
+	}
+	return best, branch
+}
@@ -0,0 +1,430 @@
+package normalizer
+
+import (
+	"encoding/xml"
+	"errors"
+	"strings"
+
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	. "github.com/bblfsh/sdk/v3/uast/transformer"
+)
+
+// typeDocumentation is a type of the node that describes XML documentation comments
+// in Semantic mode.
+const typeDocumentation = "Documentation"
+
+// docTargets is a set of node types that documentation comments are attached to.
+// All of them are bound to a name with uast:Alias and have a Docs field.
+var docTargets = map[string]bool{
+	typeDeclaration: true,
+	typeProperty:    true,
+	typeIndexer:     true,
+	typeEvent:       true,
+}
+
+// docElem is a top-level element of the documentation comment.
+type docElem struct {
+	name  string
+	attrs map[string]string
+	text  strings.Builder
+}
+
+// docRefElem is an inline cross-reference element of the documentation comment.
+type docRefElem struct {
+	start int    // text length at the start of the element
+	ref   string // reference target
+}
+
+// docRef returns a cross-reference target of see, seealso, paramref and typeparamref elements.
+func docRef(attrs []xml.Attr) string {
+	for _, name := range []string{"cref", "href", "langword", "name"} {
+		for _, a := range attrs {
+			if a.Name.Local == name {
+				return a.Value
+			}
+		}
+	}
+	return ""
+}
+
+// docText trims the whitespace on each line of the element text and drops leading
+// and trailing empty lines.
+func docText(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// trimDocStars removes leading asterisks from lines of /** */ documentation comments.
+func trimDocStars(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		line = strings.TrimLeft(line, " \t")
+		if strings.HasPrefix(line, "*") {
+			lines[i] = line[1:]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseDoc parses the text of XML documentation comment and returns an object with
+// well-known documentation elements.
+//
+// Summary, Remarks, Returns and Value fields are set to the text of corresponding elements,
+// or to nil if the element is not present. Params, TypeParams and Exceptions are the lists
+// of objects with the element text and the parameter name (or exception type). See and SeeAlso
+// are the lists of all cross-references, including ones inside other elements.
+//
+// Malformed XML is parsed up to the first error.
+func parseDoc(text string) nodes.Object {
+	doc := nodes.Object{
+		"Summary":    nil,
+		"Remarks":    nil,
+		"Returns":    nil,
+		"Value":      nil,
+		"Params":     nodes.Array{},
+		"TypeParams": nodes.Array{},
+		"Exceptions": nodes.Array{},
+		"See":        nodes.Array{},
+		"SeeAlso":    nodes.Array{},
+	}
+	dec := xml.NewDecoder(strings.NewReader("<doc>" + text + "</doc>"))
+	dec.Strict = false
+
+	var (
+		cur   *docElem
+		depth int
+		// inline see and seealso elements
+		refs []docRefElem
+	)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			depth++
+			name := tok.Name.Local
+			if name == "see" || name == "seealso" {
+				field := "See"
+				if name == "seealso" {
+					field = "SeeAlso"
+				}
+				if ref := docRef(tok.Attr); ref != "" {
+					doc[field] = append(doc[field].(nodes.Array), nodes.String(ref))
+				}
+			}
+			if depth == 2 {
+				cur = &docElem{name: name, attrs: make(map[string]string)}
+				for _, a := range tok.Attr {
+					cur.attrs[a.Name.Local] = a.Value
+				}
+			} else if depth > 2 && cur != nil {
+				switch name {
+				case "paramref", "typeparamref":
+					cur.text.WriteString(docRef(tok.Attr))
+				case "see", "seealso":
+					refs = append(refs, docRefElem{start: cur.text.Len(), ref: docRef(tok.Attr)})
+				}
+			}
+		case xml.EndElement:
+			depth--
+			name := tok.Name.Local
+			if depth > 1 && cur != nil && (name == "see" || name == "seealso") && len(refs) != 0 {
+				// use the reference as a text, if the element has no text
+				ref := refs[len(refs)-1]
+				refs = refs[:len(refs)-1]
+				if cur.text.Len() == ref.start {
+					cur.text.WriteString(ref.ref)
+				}
+			}
+			if depth == 1 && cur != nil {
+				addDocElem(doc, cur)
+				cur = nil
+			}
+		case xml.CharData:
+			if cur != nil {
+				cur.text.Write(tok)
+			}
+		}
+	}
+	return doc
+}
+
+// addDocElem adds a top-level element of the documentation comment to the object.
+func addDocElem(doc nodes.Object, e *docElem) {
+	text := nodes.String(docText(e.text.String()))
+	switch e.name {
+	case "summary":
+		doc["Summary"] = text
+	case "remarks":
+		doc["Remarks"] = text
+	case "returns":
+		doc["Returns"] = text
+	case "value":
+		doc["Value"] = text
+	case "param":
+		doc["Params"] = append(doc["Params"].(nodes.Array), nodes.Object{
+			"Name": nodes.String(e.attrs["name"]),
+			"Text": text,
+		})
+	case "typeparam":
+		doc["TypeParams"] = append(doc["TypeParams"].(nodes.Array), nodes.Object{
+			"Name": nodes.String(e.attrs["name"]),
+			"Text": text,
+		})
+	case "exception":
+		doc["Exceptions"] = append(doc["Exceptions"].(nodes.Array), nodes.Object{
+			"Cref": nodes.String(e.attrs["cref"]),
+			"Text": text,
+		})
+	}
+}
+
+var _ Op = opDocComment{}
+
+// opDocComment constructs a Documentation node from a uast:Comment node of the documentation
+// comment. The node keeps the original comment and adds fields with parsed XML elements
+// (see parseDoc).
+type opDocComment struct {
+	comment Op
+}
+
+func (op opDocComment) Kinds() nodes.Kind {
+	return nodes.KindObject
+}
+
+func (op opDocComment) Check(st *State, n nodes.Node) (bool, error) {
+	// TODO(dennwc): implement when we will need a reversal
+	//				 see https://github.com/bblfsh/sdk/issues/355
+	return false, errors.New("reversal of documentation comments is not implemented")
+}
+
+func (op opDocComment) Construct(st *State, n nodes.Node) (nodes.Node, error) {
+	c, err := op.comment.Construct(st, nil)
+	if err != nil {
+		return nil, err
+	}
+	comm, ok := c.(nodes.Object)
+	if !ok {
+		return nil, errors.New("expected a comment object")
+	}
+	text, _ := comm["Text"].(nodes.String)
+	if comm["Block"] == nodes.Bool(true) {
+		text = nodes.String(trimDocStars(string(text)))
+	}
+	doc := parseDoc(string(text))
+	doc[uast.KeyType] = nodes.String(typeDocumentation)
+	if pos, ok := comm[uast.KeyPos]; ok {
+		doc[uast.KeyPos] = pos
+	}
+	doc["Comment"] = comm
+	return doc, nil
+}
+
+var _ Op = opAttachDocs{}
+
+// opAttachDocs attaches Documentation nodes to declarations they document.
+//
+// Documentation comments are trivia, thus opMoveTrivias may put them in a few different
+// places: into the uast:Group that wraps the declaration, to a Group inside the list of
+// attributes or to the list of modifiers.
+//
+// For uast:FunctionGroup nodes, Documentation nodes are moved to the beginning of the
+// Nodes array. For type declarations, properties, indexers and events (see docTargets),
+// Documentation nodes are moved to the Docs field of the node bound by uast:Alias.
+type opAttachDocs struct {
+	sub Op
+}
+
+func (op opAttachDocs) Kinds() nodes.Kind {
+	return nodes.KindObject
+}
+
+func (op opAttachDocs) Check(st *State, n nodes.Node) (bool, error) {
+	obj, ok := n.(nodes.Object)
+	if !ok {
+		return false, nil
+	}
+	var out nodes.Node
+	switch uast.TypeOf(obj) {
+	case typeFuncGroup:
+		out = attachFuncGroupDocs(obj)
+	case typeAlias:
+		out = attachAliasDocs(obj)
+	case typeGroup:
+		out = attachGroupDocs(obj)
+	}
+	if out == nil {
+		return false, nil
+	}
+	return op.sub.Check(st, out)
+}
+
+func (op opAttachDocs) Construct(st *State, n nodes.Node) (nodes.Node, error) {
+	// TODO(dennwc): implement when we will need a reversal
+	//				 see https://github.com/bblfsh/sdk/issues/355
+	return op.sub.Construct(st, n)
+}
+
+// attachFuncGroupDocs moves Documentation nodes to the beginning of FunctionGroup.Nodes.
+// It returns nil if the node was not modified.
+func attachFuncGroupDocs(group nodes.Object) nodes.Node {
+	arr, ok := group["Nodes"].(nodes.Array)
+	if !ok {
+		return nil
+	}
+	var docs nodes.Array
+	out := make(nodes.Array, 0, len(arr))
+	for _, sub := range arr {
+		if uast.TypeOf(sub) == typeAlias {
+			out = append(out, sub)
+			continue
+		}
+		sub, d := extractDocs(sub)
+		docs = append(docs, d...)
+		if sub != nil {
+			out = append(out, sub)
+		}
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	group = group.CloneObject()
+	group["Nodes"] = append(docs, out...)
+	return group
+}
+
+// attachAliasDocs moves Documentation nodes from attributes and modifiers of the declaration
+// to its Docs field. It returns nil if the node was not modified.
+func attachAliasDocs(alias nodes.Object) nodes.Node {
+	node, ok := alias["Node"].(nodes.Object)
+	if !ok || !docTargets[uast.TypeOf(node)] {
+		return nil
+	}
+	var docs nodes.Array
+	node = node.CloneObject()
+	for _, field := range []string{"Attributes", "Modifiers"} {
+		sub, d := extractDocs(node[field])
+		docs = append(docs, d...)
+		node[field] = sub
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	return withDocs(alias, node, docs)
+}
+
+// attachGroupDocs moves Documentation nodes from uast:Group to the Docs field of the
+// declaration wrapped by the group. The group is removed if the declaration is the
+// only node left in it. It returns nil if the node was not modified.
+func attachGroupDocs(group nodes.Object) nodes.Node {
+	arr, ok := group["Nodes"].(nodes.Array)
+	if !ok {
+		return nil
+	}
+	ind := -1
+	for i, sub := range arr {
+		if uast.TypeOf(sub) != typeAlias {
+			continue
+		}
+		node, _ := sub.(nodes.Object)["Node"].(nodes.Object)
+		if docTargets[uast.TypeOf(node)] {
+			ind = i
+			break
+		}
+	}
+	if ind < 0 {
+		return nil
+	}
+	var docs nodes.Array
+	out := make(nodes.Array, 0, len(arr))
+	for i, sub := range arr {
+		if i > ind {
+			// trailing trivia documents something else
+			out = append(out, sub)
+			continue
+		}
+		if uast.TypeOf(sub) == typeDocumentation {
+			docs = append(docs, sub)
+			continue
+		}
+		out = append(out, sub)
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	alias := arr[ind].(nodes.Object)
+	node := alias["Node"].(nodes.Object).CloneObject()
+	alias = withDocs(alias, node, docs)
+	if len(out) == 1 {
+		return alias
+	}
+	out[ind-len(docs)] = alias
+	group = group.CloneObject()
+	group["Nodes"] = out
+	return group
+}
+
+// withDocs prepends Documentation nodes to the Docs field of the node and binds it
+// to the alias.
+func withDocs(alias, node nodes.Object, docs nodes.Array) nodes.Object {
+	old, _ := node["Docs"].(nodes.Array)
+	node["Docs"] = append(docs, old...)
+	alias = alias.CloneObject()
+	alias["Node"] = node
+	return alias
+}
+
+// extractDocs removes all Documentation nodes from the array or uast:Group and returns them.
+// It will unwrap the Group if only a single node is left in it. Documentation node itself is
+// replaced with nil.
+func extractDocs(n nodes.Node) (nodes.Node, nodes.Array) {
+	switch n := n.(type) {
+	case nodes.Object:
+		switch uast.TypeOf(n) {
+		case typeDocumentation:
+			return nil, nodes.Array{n}
+		case typeGroup:
+			arr, ok := n["Nodes"].(nodes.Array)
+			if !ok {
+				return n, nil
+			}
+			out, docs := extractArrDocs(arr)
+			if len(docs) == 0 {
+				return n, nil
+			}
+			if len(out) == 1 {
+				return out[0], docs
+			}
+			n = n.CloneObject()
+			n["Nodes"] = out
+			return n, docs
+		}
+	case nodes.Array:
+		out, docs := extractArrDocs(n)
+		if len(docs) == 0 {
+			return n, nil
+		}
+		return out, docs
+	}
+	return n, nil
+}
+
+// extractArrDocs is the same as extractDocs, but for arrays.
+func extractArrDocs(arr nodes.Array) (nodes.Array, nodes.Array) {
+	var docs nodes.Array
+	out := make(nodes.Array, 0, len(arr))
+	for _, sub := range arr {
+		sub, d := extractDocs(sub)
+		docs = append(docs, d...)
+		if sub != nil {
+			out = append(out, sub)
+		}
+	}
+	return out, docs
+}
@@ -0,0 +1,74 @@
+package normalizer
+
+import (
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	. "github.com/bblfsh/sdk/v3/uast/transformer"
+)
+
+// keySchemaDefaults is a field of the root node of the lean native AST that stores values of
+// omitted fields, by node type.
+const keySchemaDefaults = "SchemaDefaults"
+
+var _ Transformer = restoreLean{}
+
+// restoreLean is a transformation that converts the lean native AST to the full schema,
+// thus the rest of transformations can be written for a single schema.
+//
+// The lean AST is detected by the SchemaDefaults field of the root node. For each node type
+// listed there, the transformation adds omitted fields with their default values. It also sets
+// Value and ValueText of tokens to Text, if they are omitted. Whitespace trivia are not restored,
+// since preprocessing removes them anyway.
+//
+// ASTs in the full schema are not changed.
+type restoreLean struct{}
+
+func (restoreLean) Do(root nodes.Node) (nodes.Node, error) {
+	obj, ok := root.(nodes.Object)
+	if !ok {
+		return root, nil
+	}
+	defaults, ok := obj[keySchemaDefaults].(nodes.Object)
+	if !ok {
+		return root, nil
+	}
+	obj = obj.CloneObject()
+	delete(obj, keySchemaDefaults)
+
+	out, _ := nodes.Apply(obj, func(n nodes.Node) (nodes.Node, bool) {
+		obj, ok := n.(nodes.Object)
+		if !ok {
+			return n, false
+		}
+		var changed bool
+		set := func(k string, v nodes.Node) {
+			if _, ok := obj[k]; ok {
+				return
+			}
+			if !changed {
+				obj = obj.CloneObject()
+				changed = true
+			}
+			obj[k] = v
+		}
+		if typ, ok := obj[uast.KeyType].(nodes.String); ok {
+			fields, _ := defaults[string(typ)].(nodes.Object)
+			for k, v := range fields {
+				set(k, v)
+			}
+		}
+		if text, ok := obj["Text"].(nodes.String); ok && isLeanToken(obj) {
+			set("Value", text)
+			set("ValueText", text)
+		}
+		return obj, changed
+	})
+	return out, nil
+}
+
+// isLeanToken checks if the native node is a syntax token. Only tokens have both the text and trivia.
+func isLeanToken(obj nodes.Object) bool {
+	_, ok1 := obj["LeadingTrivia"]
+	_, ok2 := obj["TrailingTrivia"]
+	return ok1 && ok2
+}
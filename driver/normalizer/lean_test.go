@@ -0,0 +1,130 @@
+package normalizer
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	"github.com/bblfsh/sdk/v3/uast/uastyaml"
+)
+
+// leanFields are fields omitted from the lean native AST if they have a default value.
+var leanFields = []string{"IsMissing", "IsStructuredTrivia", "IsVar", "IsUnmanaged", "Arity"}
+
+// toLean converts the native AST in the full schema to the lean schema, the same way
+// the native parser does.
+func toLean(root nodes.Node) nodes.Node {
+	defaults := make(nodes.Object)
+	var conv func(n nodes.Node) nodes.Node
+	conv = func(n nodes.Node) nodes.Node {
+		switch n := n.(type) {
+		case nodes.Object:
+			typ := uast.TypeOf(n)
+			out := make(nodes.Object, len(n))
+			for k, v := range n {
+				out[k] = conv(v)
+			}
+			for _, k := range leanFields {
+				if v, ok := out[k]; ok && (v == nodes.Bool(false) || v == nodes.Int(0)) {
+					fields, _ := defaults[typ].(nodes.Object)
+					if fields == nil {
+						fields = make(nodes.Object)
+						defaults[typ] = fields
+					}
+					fields[k] = v
+					delete(out, k)
+				}
+			}
+			if text, ok := out["Text"].(nodes.String); ok && isLeanToken(out) &&
+				out["Value"] == text && out["ValueText"] == text {
+				delete(out, "Value")
+				delete(out, "ValueText")
+			}
+			return out
+		case nodes.Array:
+			out := make(nodes.Array, 0, len(n))
+			for _, v := range n {
+				if isWhitespace(v) {
+					continue
+				}
+				out = append(out, conv(v))
+			}
+			return out
+		}
+		return n
+	}
+	out := conv(root).(nodes.Object)
+	out[keySchemaDefaults] = defaults
+	return out
+}
+
+func isWhitespace(n nodes.Node) bool {
+	switch uast.TypeOf(n) {
+	case "WhitespaceTrivia", "EndOfLineTrivia":
+		return true
+	}
+	return false
+}
+
+// dropWhitespace removes whitespace trivia from the native AST.
+func dropWhitespace(n nodes.Node) nodes.Node {
+	out, _ := nodes.Apply(n, func(n nodes.Node) (nodes.Node, bool) {
+		arr, ok := n.(nodes.Array)
+		if !ok {
+			return n, false
+		}
+		var out nodes.Array
+		for _, v := range arr {
+			if !isWhitespace(v) {
+				out = append(out, v)
+			}
+		}
+		if len(out) == len(arr) {
+			return n, false
+		}
+		if out == nil {
+			out = nodes.Array{}
+		}
+		return out, true
+	})
+	return out
+}
+
+func TestRestoreLean(t *testing.T) {
+	for _, name := range []string{"hello.cs", "generics.cs", "string_interpolated.cs"} {
+		t.Run(name, func(t *testing.T) {
+			data, err := ioutil.ReadFile(filepath.Join("../../fixtures", name+".native"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			full, err := uastyaml.Unmarshal(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lean := toLean(full)
+			if nodes.Equal(lean, full) {
+				t.Fatal("expected the lean AST to be different")
+			}
+			got, err := restoreLean{}.Do(lean)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// whitespace trivia are not restored, see restoreLean
+			exp := dropWhitespace(full)
+			if !nodes.Equal(exp, got) {
+				t.Fatal("the restored AST is different from the full AST")
+			}
+
+			// ASTs in the full schema are not changed
+			got, err = restoreLean{}.Do(full)
+			if err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(full, got) {
+				t.Fatal("the full AST was modified")
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package normalizer
+
+import (
+	"strings"
+
+	"github.com/bblfsh/sdk/v3/uast"
+	"github.com/bblfsh/sdk/v3/uast/nodes"
+	. "github.com/bblfsh/sdk/v3/uast/transformer"
+)
+
+const (
+	// typeMissingNode is a type of the placeholder node that replaces a syntax node that
+	// was inserted by the parser during error recovery.
+	typeMissingNode = "MissingNode"
+
+	// keyDiagnostics is a field of the root node with syntax errors and warnings
+	// reported by the parser.
+	keyDiagnostics = "Diagnostics"
+	// keyErroneous is a field that marks semantic nodes that contain syntax errors.
+	keyErroneous = "Erroneous"
+)
+
+var _ Transformer = markMissing{}
+
+// markMissing is a transformation that replaces missing nodes in error-recovered trees with
+// explicit placeholders.
+//
+// Roslyn always produces a complete tree, even if the source has syntax errors. Nodes and
+// tokens that the parser expected, but haven't found in the source are inserted with the
+// IsMissing flag set. Semantic mappings only accept nodes that are not missing, thus any
+// missing node prevents its whole parent from being mapped.
+//
+// To avoid this, the transformation:
+//
+//   - replaces missing syntax nodes, identifiers and literals with MissingNode placeholders
+//     that have a zero-length position where the node was expected, and the Kind field with
+//     the native type of the missing node;
+//   - resets the IsMissing flag of missing tokens. Tokens are dropped by semantic mappings,
+//     thus the enclosing node is marked by markErroneous instead.
+type markMissing struct{}
+
+func (markMissing) Do(root nodes.Node) (nodes.Node, error) {
+	out, _ := nodes.Apply(root, func(n nodes.Node) (nodes.Node, bool) {
+		obj, ok := n.(nodes.Object)
+		if !ok || obj["IsMissing"] != nodes.Bool(true) {
+			return n, false
+		}
+		if isToken(obj) {
+			obj = obj.CloneObject()
+			obj["IsMissing"] = nodes.Bool(false)
+			return obj, true
+		}
+		placeholder := nodes.Object{
+			uast.KeyType: nodes.String(typeMissingNode),
+			"Kind":       nodes.String(uast.TypeOf(obj)),
+		}
+		if pos, ok := obj[uast.KeyPos]; ok {
+			placeholder[uast.KeyPos] = pos
+		}
+		return placeholder, true
+	})
+	return out, nil
+}
+
+// isToken checks if the native node is a syntax token with a fixed text, like a keyword
+// or a punctuation. Identifiers and literals are not considered.
+func isToken(obj nodes.Object) bool {
+	typ := uast.TypeOf(obj)
+	if !strings.HasSuffix(typ, "Token") && !strings.HasSuffix(typ, "Keyword") {
+		return false
+	}
+	if typ == "IdentifierToken" || strings.HasSuffix(typ, "LiteralToken") {
+		return false
+	}
+	_, ok := obj["ValueText"]
+	return ok
+}
+
+var _ Transformer = markErroneous{}
+
+// markErroneous is a transformation that sets the Erroneous field of semantic nodes that
+// contain syntax errors.
+//
+// Errors are taken from the Diagnostics field of the root node. Each error marks the innermost
+// semantic node that has a position and encloses the start of the error. Warnings are ignored.
+//
+// It must run after semantic mappings.
+type markErroneous struct{}
+
+func (markErroneous) Do(root nodes.Node) (nodes.Node, error) {
+	obj, ok := root.(nodes.Object)
+	if !ok {
+		return root, nil
+	}
+	diags, _ := obj[keyDiagnostics].(nodes.Array)
+	var offs []uint32
+	for _, d := range diags {
+		d, ok := d.(nodes.Object)
+		if !ok || d["Severity"] != nodes.String("Error") {
+			continue
+		}
+		if start := uast.PositionsOf(d).Start(); start != nil && start.HasOffset() {
+			offs = append(offs, start.Offset)
+		}
+	}
+	if len(offs) == 0 {
+		return root, nil
+	}
+	out, _ := markErrors(root, offs, false)
+	return out, nil
+}
+
+// markErrors sets the Erroneous field of the innermost semantic nodes that enclose error offsets.
+// It returns the new node and offsets of errors enclosed by it. Each error marks a single node.
+//
+// Errors for missing tokens have a zero length and are located right after the previous token.
+// Thus, the end of semantic nodes is excluded, unless there is no enclosing semantic node.
+func markErrors(n nodes.Node, offs []uint32, nested bool) (nodes.Node, []uint32) {
+	switch n := n.(type) {
+	case nodes.Object:
+		semantic := false
+		if strings.HasPrefix(uast.TypeOf(n), uast.NS+":") {
+			pos := uast.PositionsOf(n)
+			start, end := pos.Start(), pos.End()
+			if start != nil && end != nil && start.HasOffset() && end.HasOffset() {
+				semantic = true
+				offs = enclosed(offs, start.Offset, end.Offset, !nested)
+			}
+		}
+		if len(offs) == 0 {
+			return n, nil
+		}
+		out, rest := n, offs
+		for _, k := range n.Keys() {
+			if len(rest) == 0 {
+				break
+			}
+			v, claimed := markErrors(n[k], rest, nested || semantic)
+			if len(claimed) == 0 {
+				continue
+			}
+			if len(rest) == len(offs) {
+				out = n.CloneObject()
+			}
+			out[k] = v
+			rest = without(rest, claimed)
+		}
+		if semantic && len(rest) != 0 {
+			// some errors are not enclosed by any child node
+			if len(rest) == len(offs) {
+				out = n.CloneObject()
+			}
+			out[keyErroneous] = nodes.Bool(true)
+			rest = nil
+		}
+		return out, without(offs, rest)
+	case nodes.Array:
+		out, rest := n, offs
+		for i, v := range n {
+			if len(rest) == 0 {
+				break
+			}
+			v, claimed := markErrors(v, rest, nested)
+			if len(claimed) == 0 {
+				continue
+			}
+			if len(rest) == len(offs) {
+				out = n.CloneList()
+			}
+			out[i] = v
+			rest = without(rest, claimed)
+		}
+		return out, without(offs, rest)
+	}
+	return n, nil
+}
+
+// enclosed returns offsets in the [start, end) range. The end is included if inclusive is set,
+// or if the range is empty.
+func enclosed(offs []uint32, start, end uint32, inclusive bool) []uint32 {
+	var out []uint32
+	for _, off := range offs {
+		if start <= off && (off < end || (off == end && (inclusive || start == end))) {
+			out = append(out, off)
+		}
+	}
+	return out
+}
+
+// without returns offsets that are not in the list.
+func without(offs, list []uint32) []uint32 {
+	var out []uint32
+	for _, off := range offs {
+		found := false
+		for _, off2 := range list {
+			if off == off2 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, off)
+		}
+	}
+	return out
+}
@@ -11,10 +11,15 @@ import (
 )
 
 var Preprocess = Transformers([][]Transformer{
+	// Restore fields omitted from the lean native AST.
+	{restoreLean{}},
 	{Mappings(Preprocessors...)},
 }...)
 
 var Normalize = Transformers([][]Transformer{
+	// Replace nodes and tokens inserted by the parser during error recovery
+	// with placeholders, so the enclosing nodes can still be normalized.
+	{markMissing{}},
 	{Mappings(
 		// Move the Leading/TrailingTrivia outside of nodes.
 		//
@@ -26,6 +31,30 @@ var Normalize = Transformers([][]Transformer{
 		),
 	)},
 	{Mappings(Normalizers...)},
+	{Mappings(
+		// Attach documentation comments to declarations.
+		//
+		// This should happen after all declarations and comments were converted
+		// and trivia groups were merged into function groups.
+		Map(
+			opAttachDocs{Var("node")},
+			Check(
+				Has{uast.KeyType: In(
+					nodes.String(typeFuncGroup),
+					nodes.String(typeGroup),
+					nodes.String(typeAlias),
+				)},
+				Var("node"),
+			),
+		),
+	)},
+	// Mark semantic nodes that contain syntax errors.
+	{markErroneous{}},
+	// Pair preprocessor directives.
+	//
+	// Directives are scattered over the tree by opMoveTrivias, thus it should
+	// be the last step that sees the whole tree.
+	{pairDirectives{}},
 }...)
 
 var _ Op = opArrHasKeyword{}
@@ -104,14 +133,77 @@ func (op opArrHasKeyword) Construct(st *State, n nodes.Node) (nodes.Node, error)
 	return n, nil
 }
 
+var _ Op = opArrContainsKeyword{}
+
+// opArrContainsKeyword is similar to opArrHasKeyword, but it doesn't remove the keyword
+// from the array. Instead, the array is passed to opArr as-is.
+type opArrContainsKeyword struct {
+	keyword string
+	opHas   Op
+	opArr   Op
+}
+
+func (op opArrContainsKeyword) Kinds() nodes.Kind {
+	return nodes.KindArray
+}
+
+func (op opArrContainsKeyword) Check(st *State, n nodes.Node) (bool, error) {
+	arr, ok := n.(nodes.Array)
+	if !ok && n != nil {
+		return false, nil
+	}
+	found := false
+	for _, sub := range arr {
+		if uast.TypeOf(sub) == op.keyword {
+			found = true
+			break
+		}
+	}
+	if ok, err := op.opHas.Check(st, nodes.Bool(found)); err != nil || !ok {
+		return ok, err
+	}
+	return op.opArr.Check(st, n)
+}
+
+func (op opArrContainsKeyword) Construct(st *State, n nodes.Node) (nodes.Node, error) {
+	// the flag can be derived from the array, so we only need to restore it
+	return op.opArr.Construct(st, n)
+}
+
+var _ Op = opArrNotEmpty{}
+
+// opArrNotEmpty checks if the array is not empty and passes the result as a boolean flag
+// to opHas. The array is passed to opArr as-is.
+type opArrNotEmpty struct {
+	opHas Op
+	opArr Op
+}
+
+func (op opArrNotEmpty) Kinds() nodes.Kind {
+	return nodes.KindArray | nodes.KindNil
+}
+
+func (op opArrNotEmpty) Check(st *State, n nodes.Node) (bool, error) {
+	arr, ok := n.(nodes.Array)
+	if !ok && n != nil {
+		return false, nil
+	}
+	if ok, err := op.opHas.Check(st, nodes.Bool(len(arr) != 0)); err != nil || !ok {
+		return ok, err
+	}
+	return op.opArr.Check(st, n)
+}
+
+func (op opArrNotEmpty) Construct(st *State, n nodes.Node) (nodes.Node, error) {
+	// the flag can be derived from the array, so we only need to restore it
+	return op.opArr.Construct(st, n)
+}
+
 var _ Op = opArrToChain{}
 
 type opArrToChain struct {
 	opMods Op
 	opType Op
-	// TODO(dennwc): maybe whitelist only known modifiers? seen so far:
-	//  			 - RefKeyword
-	//				 - OutKeyword (we should move it to Returns)
 }
 
 func (op opArrToChain) Kinds() nodes.Kind {
@@ -167,127 +259,1215 @@ func (op opArrToChain) Construct(st *State, n nodes.Node) (nodes.Node, error) {
 	return typ, nil
 }
 
-// funcDefMap creates a common annotation structure for methods with a specified AST type.
+// typeByRef is a type of the node that wraps a type of by-reference parameters.
+const typeByRef = "ByRefType"
+
+// byRefKinds maps a keyword of a by-reference parameter to the parameter kind.
+var byRefKinds = map[string]string{
+	"RefKeyword": "ref",
+	"OutKeyword": "out",
+	"InKeyword":  "in",
+}
+
+var _ Op = opByRefModifiers{}
+
+// opByRefModifiers converts ref, out, in and readonly keywords of the parameter
+// to a single ByRefType node that can be chained to the parameter type with opArrToChain.
+//
+// The node has a Kind field that is set to "ref", "out" or "in" and a ReadOnly flag
+// that is set for "in" and "ref readonly" parameters.
+//
+// Only these keywords are allowed in the array. If any other modifier is found,
+// the check will fail.
+type opByRefModifiers struct {
+	op Op
+}
+
+func (op opByRefModifiers) Kinds() nodes.Kind {
+	return nodes.KindArray
+}
+
+func (op opByRefModifiers) Check(st *State, n nodes.Node) (bool, error) {
+	arr, ok := n.(nodes.Array)
+	if !ok && n != nil {
+		return false, nil
+	}
+	var (
+		ref      nodes.Object
+		readonly bool
+	)
+	for _, sub := range arr {
+		typ := uast.TypeOf(sub)
+		if typ == "ReadOnlyKeyword" {
+			readonly = true
+			continue
+		}
+		kind, ok := byRefKinds[typ]
+		if !ok || ref != nil {
+			// unknown modifier, or more than one by-reference keyword
+			return false, nil
+		}
+		ref = nodes.Object{
+			uast.KeyType: nodes.String(typeByRef),
+			"Kind":       nodes.String(kind),
+		}
+		if pos, ok := sub.(nodes.Object)[uast.KeyPos]; ok {
+			ref[uast.KeyPos] = pos
+		}
+	}
+	if ref == nil {
+		if readonly {
+			// readonly alone is not a valid parameter modifier
+			return false, nil
+		}
+		return op.op.Check(st, nodes.Array{})
+	}
+	ref["ReadOnly"] = nodes.Bool(readonly || ref["Kind"] == nodes.String("in"))
+	return op.op.Check(st, nodes.Array{ref})
+}
+
+func (op opByRefModifiers) Construct(st *State, n nodes.Node) (nodes.Node, error) {
+	// TODO(dennwc): implement when we will need a reversal
+	//				 see https://github.com/bblfsh/sdk/issues/355
+	return op.op.Construct(st, n)
+}
+
+var _ Op = opSplitOut{}
+
+// opSplitOut splits an array of uast:Argument nodes into regular arguments and "out"
+// arguments (see opByRefModifiers). Regular arguments are passed to opArgs, while "out"
+// arguments are passed to opOuts. If there are no "out" arguments, opOuts will receive nil.
+type opSplitOut struct {
+	opArgs Op
+	opOuts Op
+}
+
+func (op opSplitOut) Kinds() nodes.Kind {
+	return nodes.KindArray
+}
+
+func (op opSplitOut) Check(st *State, n nodes.Node) (bool, error) {
+	arr, ok := n.(nodes.Array)
+	if !ok && n != nil {
+		return false, nil
+	}
+	var args, outs nodes.Array
+	for i, sub := range arr {
+		if !isOutArg(sub) {
+			if args != nil {
+				args = append(args, sub)
+			}
+			continue
+		}
+		if args == nil {
+			args = make(nodes.Array, i, len(arr)-1)
+			copy(args, arr[:i])
+		}
+		outs = append(outs, sub)
+	}
+	if outs == nil {
+		args = arr
+	}
+	if ok, err := op.opArgs.Check(st, args); err != nil || !ok {
+		return ok, err
+	}
+	if len(outs) == 0 {
+		return op.opOuts.Check(st, nil)
+	}
+	return op.opOuts.Check(st, outs)
+}
+
+func (op opSplitOut) Construct(st *State, n nodes.Node) (nodes.Node, error) {
+	// TODO(dennwc): implement when we will need a reversal
+	//				 see https://github.com/bblfsh/sdk/issues/355
+	return op.opArgs.Construct(st, n)
+}
+
+// isOutArg checks if the node is a uast:Argument with "out" modifier.
+//
+// The modifier is chained to the Type field of the argument (see opArrToChain).
+func isOutArg(n nodes.Node) bool {
+	obj, ok := n.(nodes.Object)
+	if !ok || uast.TypeOf(obj) != typeArgument {
+		return false
+	}
+	typ, ok := obj["Type"].(nodes.Object)
+	if !ok || uast.TypeOf(typ) != typeByRef {
+		return false
+	}
+	return typ["Kind"] == nodes.String("out")
+}
+
+var _ Op = opAutoAccessors{}
+
+// opAutoAccessors checks if none of the property accessors have a body and passes
+// the result as a boolean flag to opAuto. The accessors array is passed to opArr as-is.
+type opAutoAccessors struct {
+	opAuto Op
+	opArr  Op
+}
+
+func (op opAutoAccessors) Kinds() nodes.Kind {
+	return nodes.KindArray
+}
+
+func (op opAutoAccessors) Check(st *State, n nodes.Node) (bool, error) {
+	arr, ok := n.(nodes.Array)
+	if !ok {
+		return false, nil
+	}
+	auto := len(arr) != 0
+	for _, sub := range arr {
+		if !isBodyless(sub) {
+			auto = false
+			break
+		}
+	}
+	if ok, err := op.opAuto.Check(st, nodes.Bool(auto)); err != nil || !ok {
+		return ok, err
+	}
+	return op.opArr.Check(st, n)
+}
+
+func (op opAutoAccessors) Construct(st *State, n nodes.Node) (nodes.Node, error) {
+	// TODO(dennwc): implement when we will need a reversal
+	//				 see https://github.com/bblfsh/sdk/issues/355
+	return op.opArr.Construct(st, n)
+}
+
+// isBodyless checks if the accessor has no body. Accessor can either be a uast:FunctionGroup
+// (see accessorDefMap), or a native node, if it wasn't converted.
+func isBodyless(n nodes.Node) bool {
+	obj, ok := n.(nodes.Object)
+	if !ok {
+		return false
+	}
+	if uast.TypeOf(obj) != typeFuncGroup {
+		return obj["Body"] == nil && obj["ExpressionBody"] == nil
+	}
+	arr, _ := obj["Nodes"].(nodes.Array)
+	for _, sub := range arr {
+		if uast.TypeOf(sub) != typeAlias {
+			continue
+		}
+		fnc, ok := sub.(nodes.Object)["Node"].(nodes.Object)
+		if !ok {
+			return false
+		}
+		return fnc["Body"] == nil
+	}
+	return false
+}
+
+var _ Op = opInterfaceName{}
+
+// opInterfaceName converts the name of an explicitly implemented interface to a
+// uast:QualifiedIdentifier and passes it to op.
+//
+// The name can be a uast:Identifier, a uast:QualifiedIdentifier or a native QualifiedName,
+// with a native GenericName as the last name. Generic names are converted to a single
+// uast:Identifier that includes type arguments, for example "IEnumerable<int>".
+// The check fails if the name cannot be converted.
+type opInterfaceName struct {
+	op Op
+}
+
+func (op opInterfaceName) Kinds() nodes.Kind {
+	return nodes.KindObject
+}
+
+func (op opInterfaceName) Check(st *State, n nodes.Node) (bool, error) {
+	obj, ok := n.(nodes.Object)
+	if !ok {
+		return false, nil
+	}
+	names, ok := interfaceNames(obj)
+	if !ok {
+		return false, nil
+	}
+	qual := nodes.Object{
+		uast.KeyType: nodes.String(uast.TypeOf(uast.QualifiedIdentifier{})),
+		"Names":      names,
+	}
+	if pos, ok := obj[uast.KeyPos]; ok {
+		qual[uast.KeyPos] = pos
+	}
+	return op.op.Check(st, qual)
+}
+
+func (op opInterfaceName) Construct(st *State, n nodes.Node) (nodes.Node, error) {
+	// TODO(dennwc): implement when we will need a reversal
+	//				 see https://github.com/bblfsh/sdk/issues/355
+	return op.op.Construct(st, n)
+}
+
+// interfaceNames returns a list of uast:Identifier nodes for the interface name.
+// See opInterfaceName.
+func interfaceNames(obj nodes.Object) (nodes.Array, bool) {
+	switch uast.TypeOf(obj) {
+	case typeIdent:
+		return nodes.Array{obj}, true
+	case typeQualIdent:
+		// the last name may still be a native GenericName
+		names, ok := obj["Names"].(nodes.Array)
+		if !ok {
+			return nil, false
+		}
+		out := make(nodes.Array, 0, len(names))
+		for _, n := range names {
+			n, _ := n.(nodes.Object)
+			name, ok := interfaceNames(n)
+			if !ok || len(name) != 1 {
+				return nil, false
+			}
+			out = append(out, name...)
+		}
+		return out, true
+	case "QualifiedName":
+		left, ok1 := obj["Left"].(nodes.Object)
+		right, ok2 := obj["Right"].(nodes.Object)
+		if !ok1 || !ok2 {
+			return nil, false
+		}
+		names, ok := interfaceNames(left)
+		if !ok {
+			return nil, false
+		}
+		last, ok := interfaceNames(right)
+		if !ok || len(last) != 1 {
+			return nil, false
+		}
+		return append(names, last...), true
+	case "GenericName":
+		name, ok := typeName(obj)
+		if !ok {
+			return nil, false
+		}
+		id := nodes.Object{
+			uast.KeyType: nodes.String(typeIdent),
+			"Name":       nodes.String(name),
+		}
+		if pos, ok := obj[uast.KeyPos]; ok {
+			id[uast.KeyPos] = pos
+		}
+		return nodes.Array{id}, true
+	}
+	return nil, false
+}
+
+// typeName returns the name of a type as it's written in the source, without whitespace.
+// It returns false for nodes that are not supported.
+func typeName(n nodes.Node) (string, bool) {
+	obj, ok := n.(nodes.Object)
+	if !ok {
+		return "", false
+	}
+	switch uast.TypeOf(obj) {
+	case typeIdent:
+		name, ok := obj["Name"].(nodes.String)
+		return string(name), ok
+	case typeQualIdent:
+		names, _ := obj["Names"].(nodes.Array)
+		return typeNames(names, ".")
+	case "QualifiedName":
+		left, ok1 := typeName(obj["Left"])
+		right, ok2 := typeName(obj["Right"])
+		return left + "." + right, ok1 && ok2
+	case "PredefinedType":
+		kw, _ := obj["Keyword"].(nodes.Object)
+		text, ok := kw["Text"].(nodes.String)
+		return string(text), ok
+	case "OmittedTypeArgument":
+		// unbound generic name, like List<>
+		return "", true
+	case "GenericName":
+		name, ok := typeName(obj["Identifier"])
+		if !ok {
+			return "", false
+		}
+		list, _ := obj["TypeArgumentList"].(nodes.Object)
+		args, _ := list["Arguments"].(nodes.Array)
+		sep := ","
+		if len(args) != 0 && uast.TypeOf(args[0]) != "OmittedTypeArgument" {
+			sep = ", "
+		}
+		sargs, ok := typeNames(args, sep)
+		return name + "<" + sargs + ">", ok
+	case "NullableType":
+		elem, ok := typeName(obj["ElementType"])
+		return elem + "?", ok
+	case "PointerType":
+		elem, ok := typeName(obj["ElementType"])
+		return elem + "*", ok
+	case "ArrayType":
+		elem, ok := typeName(obj["ElementType"])
+		ranks, _ := obj["RankSpecifiers"].(nodes.Array)
+		for _, r := range ranks {
+			r, _ := r.(nodes.Object)
+			sizes, _ := r["Sizes"].(nodes.Array)
+			if len(sizes) == 0 {
+				return "", false
+			}
+			elem += "[" + strings.Repeat(",", len(sizes)-1) + "]"
+		}
+		return elem, ok
+	case "TupleType":
+		elems, _ := obj["Elements"].(nodes.Array)
+		types := make(nodes.Array, 0, len(elems))
+		for _, e := range elems {
+			e, _ := e.(nodes.Object)
+			types = append(types, e["Type"])
+		}
+		s, ok := typeNames(types, ", ")
+		return "(" + s + ")", ok
+	}
+	return "", false
+}
+
+// typeNames returns names of all types, joined with a separator. See typeName.
+func typeNames(arr nodes.Array, sep string) (string, bool) {
+	names := make([]string, 0, len(arr))
+	for _, n := range arr {
+		name, ok := typeName(n)
+		if !ok {
+			return "", false
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, sep), true
+}
+
+// paramDefMap creates an annotation structure for parameters with a specified native
+// AST structure (src) and fields of the resulting uast:Argument (dst).
+//
+// uast:Argument has no field for attributes ([CallerMemberName], [FromBody], etc), thus
+// they are kept in an additional Attributes field of the argument. The field is only set
+// if the parameter has attributes. The native AST node must store them to the "attrs"
+// variable and set the "has_attrs" flag (see opArrNotEmpty).
+func paramDefMap(src, dst Obj) Mapping {
+	so, do := MapSemantic("Parameter", uast.Argument{}, MapObj(src, dst)).ObjMapping()
+	return MapObj(so, JoinObj(do, Fields{
+		{Name: "Attributes", Op: Var("attrs"), Optional: "has_attrs"},
+	}))
+}
+
+// funcDefMap creates a common annotation structure for methods and other function-like
+// declarations (local functions, destructors, etc) with a specified AST type.
+//
+// If returns field name is set, it will also convert the return value of the method from
+// this field, in other cases it will assume that the native AST node has no return type.
+//
+// Other object allows to remap custom fields from the native AST. Other fields can be
+// either asserted to a specific value, or stored to a variable and restored in the
+// FunctionGroup array using toGroup. Setting a field to nil in the other object means
+// that the native AST node has no such field.
+func funcDefMap(typ string, returns string, other Obj, toGroup ...Op) Mapping {
+	src := Obj{
+		"Identifier": Var("name"),
+	}
+	for k, v := range other {
+		src[k] = v
+	}
+	return funcDefMapNamed(typ, returns, Var("name"), src, toGroup...)
+}
+
+// funcDefMapNamed is similar to funcDefMap, but the function has no Identifier field
+// and the name is constructed by a specified operation instead. See opOperatorName.
+func funcDefMapNamed(typ string, returns string, name Op, other Obj, toGroup ...Op) Mapping {
+	src := Obj{
+		"ParameterList":      paramList(),
+		"IsMissing":          Bool(false),
+		"IsStructuredTrivia": Bool(false),
+		"SemicolonToken":     Any(),
+		"AttributeLists": Cases("caseAttrs",
+			Arr(),
+			Check(OfKind(nodes.KindArray), Var("attr")),
+			Check(OfKind(nodes.KindObject), Var("attr")),
+		),
+		"Modifiers": Cases("caseMods",
+			Arr(),
+			NotEmpty(Var("modifiers")),
+		),
+	}
+	for k, v := range other {
+		if v == nil {
+			delete(src, k)
+			continue
+		}
+		src[k] = v
+	}
+	// "out" parameters are moved to Returns, see opSplitOut
+	dstType := Obj{
+		"Arguments": Var("params"),
+		"Returns":   Var("outs"),
+	}
+	if returns != "" {
+		src[returns] = Var("rettype")
+		dstType["Returns"] = PrependOne(
+			UASTType(uast.Argument{}, Obj{
+				"Type": Var("rettype"),
+			}),
+			Var("outs"),
+		)
+	}
+	var funcGroup []Op
+	if _, ok := src["AttributeLists"]; ok {
+		funcGroup = append(funcGroup, Cases("caseAttrs",
+			Is(nil),
+			Var("attr"),
+			Arr(Var("attr")),
+		))
+	}
+	funcGroup = append(funcGroup, Cases("caseMods",
+		Is(nil),
+		NotEmpty(Var("modifiers")),
+	))
+	funcGroup = append(funcGroup, toGroup...)
+	funcGroup = append(funcGroup, UASTType(uast.Alias{}, Obj{
+		"Name": name,
+		"Node": UASTType(uast.Function{}, Obj{
+			"Type": UASTType(uast.FunctionType{}, dstType),
+			"Body": funcBody(),
+		}),
+	}))
+	return MapSemantic(typ, uast.FunctionGroup{}, MapObj(
+		funcBodyCases(src),
+		Obj{
+			"Nodes": Arr(funcGroup...),
+		},
+	))
+}
+
+// genericFunc extends the object with TypeParameterList and ConstraintClauses fields of
+// the generic function declaration. Type parameters and constraints are restored in the
+// FunctionGroup with genericFuncGroup.
+func genericFunc(other Obj) Obj {
+	other["ConstraintClauses"] = Cases("caseConstraint",
+		Arr(),
+		NotEmpty(Var("constraints")),
+	)
+	other["TypeParameterList"] = Cases("caseTypeParams",
+		Is(nil),
+		Arr(),
+		NotEmpty(Var("typeParams")),
+	)
+	return other
+}
+
+// genericFuncGroup restores type parameters and constraints matched by genericFunc.
+func genericFuncGroup() []Op {
+	return []Op{
+		Cases("caseTypeParams",
+			Is(nil),
+			Is(nil),
+			NotEmpty(Var("typeParams")),
+		),
+		Cases("caseConstraint",
+			Is(nil),
+			NotEmpty(Var("constraints")),
+		),
+	}
+}
+
+// operatorNames maps the operator token to a name of the operator method in CLR metadata.
+// The first name is used for unary operators and the second one - for binary operators.
+var operatorNames = map[string][2]string{
+	"PlusToken":                   {"op_UnaryPlus", "op_Addition"},
+	"MinusToken":                  {"op_UnaryNegation", "op_Subtraction"},
+	"ExclamationToken":            {"op_LogicalNot", ""},
+	"TildeToken":                  {"op_OnesComplement", ""},
+	"PlusPlusToken":               {"op_Increment", ""},
+	"MinusMinusToken":             {"op_Decrement", ""},
+	"TrueKeyword":                 {"op_True", ""},
+	"FalseKeyword":                {"op_False", ""},
+	"AsteriskToken":               {"", "op_Multiply"},
+	"SlashToken":                  {"", "op_Division"},
+	"PercentToken":                {"", "op_Modulus"},
+	"AmpersandToken":              {"", "op_BitwiseAnd"},
+	"BarToken":                    {"", "op_BitwiseOr"},
+	"CaretToken":                  {"", "op_ExclusiveOr"},
+	"LessThanLessThanToken":       {"", "op_LeftShift"},
+	"GreaterThanGreaterThanToken": {"", "op_RightShift"},
+	"EqualsEqualsToken":           {"", "op_Equality"},
+	"ExclamationEqualsToken":      {"", "op_Inequality"},
+	"LessThanToken":               {"", "op_LessThan"},
+	"GreaterThanToken":            {"", "op_GreaterThan"},
+	"LessThanEqualsToken":         {"", "op_LessThanOrEqual"},
+	"GreaterThanEqualsToken":      {"", "op_GreaterThanOrEqual"},
+	// conversion operators
+	"ImplicitKeyword": {"op_Implicit", "op_Implicit"},
+	"ExplicitKeyword": {"op_Explicit", "op_Explicit"},
+}
+
+var _ Op = opOperatorName{}
+
+// opOperatorName constructs a uast:Identifier with the name of the operator method,
+// as it appears in CLR metadata (op_Addition, op_Implicit, etc). The identifier will
+// have the position of the operator token.
+//
+// Since the same token may be used for unary and binary operators, the name also
+// depends on the number of parameters.
+type opOperatorName struct {
+	token  Op
+	params Op
+}
+
+func (op opOperatorName) Kinds() nodes.Kind {
+	return nodes.KindObject
+}
+
+func (op opOperatorName) Check(st *State, n nodes.Node) (bool, error) {
+	// TODO(dennwc): implement when we will need a reversal
+	//				 see https://github.com/bblfsh/sdk/issues/355
+	return false, errors.New("reversal of operator names is not implemented")
+}
+
+func (op opOperatorName) Construct(st *State, n nodes.Node) (nodes.Node, error) {
+	tok, err := op.token.Construct(st, nil)
+	if err != nil {
+		return nil, err
+	}
+	params, err := op.params.Construct(st, nil)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := tok.(nodes.Object)
+	if !ok {
+		return nil, fmt.Errorf("expected an operator token, got: %T", tok)
+	}
+	typ := uast.TypeOf(obj)
+	i := 1
+	if arr, _ := params.(nodes.Array); len(arr) == 1 {
+		i = 0
+	}
+	name := operatorNames[typ][i]
+	if name == "" {
+		// unknown or invalid operator, but we still want a stable name
+		name = "op_" + strings.TrimSuffix(typ, "Token")
+	}
+	id := nodes.Object{
+		uast.KeyType: nodes.String(uast.TypeOf(uast.Identifier{})),
+		"Name":       nodes.String(name),
+	}
+	if pos, ok := obj[uast.KeyPos]; ok {
+		id[uast.KeyPos] = pos
+	}
+	return id, nil
+}
+
+// typeConstructor is a type of the node that is added to a FunctionGroup of the constructor.
+// It allows to distinguish constructors from regular methods and has a Static flag that is set
+// for static (type) constructors.
+const typeConstructor = "Constructor"
+
+// ctorInitStmts prepends a constructor initializer to the list of statements,
+// if the initializer was set. See ConstructorDeclaration mapping.
+func ctorInitStmts(stmts Op) Op {
+	return If("hasInit",
+		// case 1: has base or this initializer
+		PrependOne(Var("init"), stmts),
+		// case 2: no initializer
+		stmts,
+	)
+}
+
+// paramList matches a ParameterList node of the function-like declaration.
+//
+// Parameters are stored in the "params" variable and "out" parameters are stored
+// separately in the "outs" variable, see opSplitOut.
+func paramList() Op {
+	return Obj{
+		uast.KeyType:         String("ParameterList"),
+		uast.KeyPos:          Any(),
+		"OpenParenToken":     Any(),
+		"CloseParenToken":    Any(),
+		"IsMissing":          Bool(false),
+		"IsStructuredTrivia": Bool(false),
+		"Parameters": opSplitOut{
+			opArgs: Var("params"),
+			opOuts: Var("outs"),
+		},
+	}
+}
+
+// lambdaDefMap creates a mapping for lambda expressions and anonymous methods.
+//
+// They are converted to an anonymous uast:Function. Since uast:Function has no field
+// for modifiers, async functions are wrapped into a uast:FunctionGroup with AsyncKeyword
+// as the first node (same as modifiers of regular methods).
+//
+// Lambdas with an expression body will have the body wrapped into a uast:Block
+// with a csharp:Return node containing the expression (similar to arrowBlock).
+// For this, the "isExpr" variable must be set by one of the body cases.
+//
+// TODO(dennwc): map static lambdas (C# 9) when we update Roslyn
+func lambdaDefMap(typ string, async bool, src, ftype Obj, bodies Objs) Mapping {
+	fnc := Obj{
+		"Type": UASTType(uast.FunctionType{}, ftype),
+		"Body": Cases("isExpr",
+			// case 1: full body
+			Var("body"),
+			// case 2: expression
+			UASTType(uast.Block{}, Obj{
+				"Statements": Arr(
+					Obj{
+						uast.KeyType: String("ReturnStatement"),
+						uast.KeyPos:  Var("arrow_pos_tok"),
+						"Expression": Var("body"),
+					},
+				),
+			}),
+		),
+	}
+	obj := Obj{
+		"IsMissing":          Bool(false),
+		"IsStructuredTrivia": Bool(false),
+	}
+	for k, v := range src {
+		obj[k] = v
+	}
+	if !async {
+		obj["AsyncKeyword"] = Check(HasType("None"), Any())
+		return MapSemantic(typ, uast.Function{}, MapObj(
+			CasesObj("isExpr", obj, bodies),
+			fnc,
+		))
+	}
+	obj["AsyncKeyword"] = Check(HasType("AsyncKeyword"), Var("async"))
+	return MapSemantic(typ, uast.FunctionGroup{}, MapObj(
+		CasesObj("isExpr", obj, bodies),
+		Obj{
+			"Nodes": Arr(
+				Var("async"),
+				UASTType(uast.Function{}, fnc),
+			),
+		},
+	))
+}
+
+// lambdaBodies are the cases for the body of the lambda expression, see lambdaDefMap.
+var lambdaBodies = Objs{
+	// case 1: full body
+	{
+		"ArrowToken": Any(),
+		"Body":       Check(HasType(uast.Block{}), Var("body")),
+	},
+	// case 2: expression
+	{
+		"ArrowToken": Obj{
+			uast.KeyType: String("EqualsGreaterThanToken"),
+			// will use this position for Return in Body
+			uast.KeyPos: Var("arrow_pos_tok"),
+			"IsMissing": Bool(false),
+			"Text":      Any(),
+			"Value":     Any(),
+			"ValueText": Any(),
+		},
+		"Body": Var("body"),
+	},
+}
+
+// Sources and function types for lambdaDefMap.
+var (
+	simpleLambda = Obj{
+		"Parameter": Var("param"),
+	}
+	simpleLambdaType = Obj{
+		"Arguments": Arr(Var("param")),
+	}
+	parenLambda = Obj{
+		"ParameterList": paramList(),
+	}
+	parenLambdaType = Obj{
+		"Arguments": Var("params"),
+		"Returns":   Var("outs"),
+	}
+	anonMethod = Obj{
+		"DelegateKeyword": Any(),
+		// parameter list can be omitted: delegate { ... }
+		"ParameterList": Cases("hasParams",
+			Is(nil),
+			paramList(),
+		),
+		// same as Body
+		"Block": Any(),
+	}
+	anonMethodType = Obj{
+		"Arguments": Cases("hasParams", Is(nil), Var("params")),
+		"Returns":   Cases("hasParams", Is(nil), Var("outs")),
+	}
+	anonMethodBody = Objs{
+		{
+			"Body": Check(HasType(uast.Block{}), Var("body")),
+		},
+	}
+)
+
+// explicitInterface matches an optional ExplicitInterfaceSpecifier node of the member
+// declaration and stores the interface name as a uast:QualifiedIdentifier (see opInterfaceName).
+// The interface name is restored with explicitInterfaceNode.
+func explicitInterface() Op {
+	return Cases("caseIface",
+		// case 1: implicit implementation or not an interface member
+		Is(nil),
+		// case 2: explicit interface implementation
+		Obj{
+			uast.KeyType:         String("ExplicitInterfaceSpecifier"),
+			uast.KeyPos:          Any(),
+			"DotToken":           Any(),
+			"IsMissing":          Bool(false),
+			"IsStructuredTrivia": Bool(false),
+			"Name":               opInterfaceName{Var("iface")},
+		},
+	)
+}
+
+// explicitInterfaceNode restores the interface name matched by explicitInterface.
+//
+// The name is always a uast:QualifiedIdentifier. For methods, it's stored in the
+// FunctionGroup right before the uast:Alias of the function. For properties, indexers
+// and events, it's stored in the Interface field of the native node.
+func explicitInterfaceNode() Op {
+	return Cases("caseIface",
+		// case 1: implicit implementation or not an interface member
+		Is(nil),
+		// case 2: explicit interface implementation
+		Var("iface"),
+	)
+}
+
+// arrowClause matches an ArrowExpressionClause node and stores its expression and positions
+// to variables that are later used by arrowBlock.
+func arrowClause() Op {
+	return Obj{
+		uast.KeyType: String("ArrowExpressionClause"),
+		// will use this positions for Block in Body
+		uast.KeyPos: Var("arrow_pos"),
+		"ArrowToken": Obj{
+			uast.KeyType: String("EqualsGreaterThanToken"),
+			// will use this position for Return in Body
+			uast.KeyPos: Var("arrow_pos_tok"),
+			"IsMissing": Bool(false),
+			"Text":      Any(),
+			"Value":     Any(),
+			"ValueText": Any(),
+		},
+		"IsMissing":          Bool(false),
+		"IsStructuredTrivia": Bool(false),
+		"Expression":         Var("arrow"),
+	}
+}
+
+// arrowBlock generates a uast:Block with a csharp:Return node containing the expression
+// matched by arrowClause.
+func arrowBlock() Op {
+	return UASTType(uast.Block{}, Obj{
+		uast.KeyPos:  Var("arrow_pos"),
+		"Statements": Arr(arrowReturn()),
+	})
+}
+
+// arrowReturn generates a csharp:Return node containing the expression matched by arrowClause.
+func arrowReturn() Op {
+	return Obj{
+		uast.KeyType: String("ReturnStatement"),
+		uast.KeyPos:  Var("arrow_pos_tok"),
+		"Expression": Var("arrow"),
+	}
+}
+
+// funcBodyCases extends the object with Body and ExpressionBody fields of the function-like
+// native AST node. Either Body or ExpressionBody will be set. Function body is restored
+// with funcBody.
+func funcBodyCases(src Obj) ObjectOp {
+	return CasesObj("isArrow",
+		src,
+		Objs{
+			// case 1: arrow expression
+			{
+				"Body":           Is(nil),
+				"ExpressionBody": arrowClause(),
+			},
+			// case 2: full body
+			{
+				"ExpressionBody": Is(nil),
+				"Body":           Var("body"),
+			},
+		},
+	)
+}
+
+// funcBody restores the function body matched by funcBodyCases.
+//
+// If the function was defined with an arrow expression, we will generate
+// a uast:Block with a csharp:Return node containing the expression.
+func funcBody() Op {
+	return Cases("isArrow",
+		// case 1: arrow expression
+		arrowBlock(),
+		// case 2: full body
+		// TODO(dennwc): this will definitely fail the reverse transform
+		//               make a more specific node check when we need it
+		//               see https://github.com/bblfsh/sdk/issues/355
+		Var("body"),
+	)
+}
+
+// accessorDefMap creates a common annotation structure for property and event accessors
+// with a specified AST type.
+//
+// Accessor is converted to a uast:FunctionGroup with a function named after the
+// accessor keyword (name). Accessors of auto-implemented and abstract properties
+// have no body, thus Body of the function will be nil.
+func accessorDefMap(typ, name string) Mapping {
+	return MapSemantic(typ, uast.FunctionGroup{}, MapObj(
+		funcBodyCases(Obj{
+			"Keyword": Obj{
+				uast.KeyType: String(strings.Title(name) + "Keyword"),
+				uast.KeyPos:  Var("kw_pos"),
+				"IsMissing":  Bool(false),
+				"Text":       String(name),
+				"Value":      String(name),
+				"ValueText":  String(name),
+			},
+			"IsMissing":          Bool(false),
+			"IsStructuredTrivia": Bool(false),
+			"SemicolonToken":     Any(),
+			"AttributeLists": Cases("caseAttrs",
+				Arr(),
+				Check(OfKind(nodes.KindArray), Var("attr")),
+				Check(OfKind(nodes.KindObject), Var("attr")),
+			),
+			"Modifiers": Cases("caseMods",
+				Arr(),
+				NotEmpty(Var("modifiers")),
+			),
+		}),
+		Obj{
+			"Nodes": Arr(
+				Cases("caseAttrs",
+					Is(nil),
+					Var("attr"),
+					Arr(Var("attr")),
+				),
+				Cases("caseMods",
+					Is(nil),
+					NotEmpty(Var("modifiers")),
+				),
+				UASTType(uast.Alias{}, Obj{
+					"Name": UASTType(uast.Identifier{}, Obj{
+						uast.KeyPos: Var("kw_pos"),
+						"Name":      String(name),
+					}),
+					"Node": UASTType(uast.Function{}, Obj{
+						"Type": UASTType(uast.FunctionType{}, Obj{}),
+						"Body": funcBody(),
+					}),
+				}),
+			),
+		},
+	))
+}
+
+// Types of the nodes that describe property, indexer and event declarations in Semantic mode.
+const (
+	typeProperty = "Property"
+	typeIndexer  = "Indexer"
+	typeEvent    = "Event"
+)
+
+// propertyDefMap creates an annotation structure for property declarations.
 //
-// If returns flag is set, it will also convert the return value of the method, in other
-// cases it will assume that there should be no ReturnType in the native AST node.
+// Property is converted to a uast:Alias that binds the property name to a Property node.
+// The node keeps the property type, attributes and modifiers, as well as the list of
+// accessors (see accessorDefMap) and an optional initializer value.
 //
-// Other object allows to remap custom fields from the native AST. Other fields can be
-// either asserted to a specific value, or stored to a variable and restored in the
-// FunctionGroup array using toGroup.
-func funcDefMap(typ string, returns bool, other Obj, toGroup ...Op) Mapping {
-	src := Obj{
-		"Identifier": Var("name"),
-		"ParameterList": Obj{
-			uast.KeyType:         String("ParameterList"),
-			uast.KeyPos:          Any(),
-			"OpenParenToken":     Any(),
-			"CloseParenToken":    Any(),
-			"IsMissing":          Bool(false),
-			"IsStructuredTrivia": Bool(false),
-			"Parameters":         Var("params"),
+// Expression-bodied properties have no accessor list, so we will generate a single
+// "get" accessor that returns the expression, the same way as funcDefMap does.
+//
+// Auto flag is set if none of the accessors have a body.
+//
+// Explicit interface implementations are handled the same way as for methods: the interface
+// name is converted to a uast:QualifiedIdentifier (see explicitInterface) and stored in the
+// Interface field of the node. The field is nil for other properties. Indexers and events
+// (see indexerDefMap and eventDefMap) follow the same rules.
+func propertyDefMap() Mapping {
+	return propertyLikeDefMap("PropertyDeclaration", typeProperty, Var("name"),
+		Obj{
+			"Identifier": Var("name"),
+			"Initializer": Cases("caseInit",
+				Is(nil),
+				Obj{
+					uast.KeyType:         String("EqualsValueClause"),
+					uast.KeyPos:          Any(),
+					"EqualsToken":        Any(),
+					"IsMissing":          Bool(false),
+					"IsStructuredTrivia": Bool(false),
+					"Value":              Var("init"),
+				},
+			),
 		},
+		Obj{
+			"Init": Cases("caseInit",
+				Is(nil),
+				Var("init"),
+			),
+		},
+	)
+}
+
+// indexerDefMap creates an annotation structure for indexer declarations.
+//
+// Indexers are similar to properties (see propertyDefMap), but have no name and accept
+// a list of arguments in brackets. Thus, the Indexer node is bound to a "this" identifier
+// and keeps the list of arguments in addition to the list of accessors.
+func indexerDefMap() Mapping {
+	return propertyLikeDefMap("IndexerDeclaration", typeIndexer,
+		UASTType(uast.Identifier{}, Obj{
+			uast.KeyPos: Var("this_pos"),
+			"Name":      String("this"),
+		}),
+		Obj{
+			"ThisKeyword": Obj{
+				uast.KeyType: String("ThisKeyword"),
+				uast.KeyPos:  Var("this_pos"),
+				"IsMissing":  Bool(false),
+				"Text":       Any(),
+				"Value":      Any(),
+				"ValueText":  Any(),
+			},
+			"ParameterList": Obj{
+				uast.KeyType:         String("BracketedParameterList"),
+				uast.KeyPos:          Any(),
+				"OpenBracketToken":   Any(),
+				"CloseBracketToken":  Any(),
+				"IsMissing":          Bool(false),
+				"IsStructuredTrivia": Bool(false),
+				"Parameters":         Var("params"),
+			},
+		},
+		Obj{
+			"Arguments": Var("params"),
+		},
+	)
+}
+
+// propertyLikeDefMap creates a common annotation structure for properties and indexers.
+// See propertyDefMap for details.
+//
+// The node is bound to a specified name. Other fields of the native AST node can be
+// remapped with src and restored in the resulting node with dst.
+func propertyLikeDefMap(typ, node string, name Op, src, dst Obj) Mapping {
+	srcObj := Obj{
+		"Type":                       Var("type"),
+		"AttributeLists":             Var("attrs"),
+		"Modifiers":                  Var("modifiers"),
+		"ExplicitInterfaceSpecifier": explicitInterface(),
+		// TODO(dennwc): remap to custom positional fields
+		"Semicolon":          Any(),
+		"SemicolonToken":     Any(),
 		"IsMissing":          Bool(false),
 		"IsStructuredTrivia": Bool(false),
-		"SemicolonToken":     Any(),
-		"AttributeLists": Cases("caseAttrs",
-			Arr(),
-			Check(OfKind(nodes.KindArray), Var("attr")),
-			Check(OfKind(nodes.KindObject), Var("attr")),
-		),
-		"Modifiers": Cases("caseMods",
-			Arr(),
-			NotEmpty(Var("modifiers")),
-		),
-	}
-	for k, v := range other {
-		src[k] = v
 	}
-	dstType := Obj{
-		"Arguments": Var("params"),
+	for k, v := range src {
+		srcObj[k] = v
 	}
-	if returns {
-		src["ReturnType"] = Var("rettype")
-		dstType["Returns"] = One(
-			UASTType(uast.Argument{}, Obj{
-				"Type": Var("rettype"),
-			}),
-		)
+	dstObj := Obj{
+		uast.KeyType: String(node),
+		"Type":       Var("type"),
+		"Attributes": Var("attrs"),
+		"Modifiers":  Var("modifiers"),
+		"Interface":  explicitInterfaceNode(),
+		// see opAttachDocs
+		"Docs": Arr(),
 	}
-	funcGroup := []Op{
-		Cases("caseAttrs",
-			Is(nil),
-			Var("attr"),
-			Arr(Var("attr")),
-		),
-		Cases("caseMods",
-			Is(nil),
-			NotEmpty(Var("modifiers")),
-		),
+	for k, v := range dst {
+		dstObj[k] = v
 	}
-	funcGroup = append(funcGroup, toGroup...)
-	funcGroup = append(funcGroup, UASTType(uast.Alias{}, Obj{
-		"Name": Var("name"),
-		"Node": UASTType(uast.Function{}, Obj{
-			"Type": UASTType(uast.FunctionType{}, dstType),
-			// If the function was defined with an arrow expression, we will generate
-			// a uast:Block with a csharp:Return node containing the expression.
-			"Body": Cases("isArrow",
-				// case 1: arrow expression
-				UASTType(uast.Block{}, Obj{
-					uast.KeyPos: Var("arrow_pos"),
-					"Statements": Arr(
-						Obj{
-							uast.KeyType: String("ReturnStatement"),
-							uast.KeyPos:  Var("arrow_pos_tok"),
-							"Expression": Var("arrow"),
-						},
-					),
-				}),
-				// case 2: full body
-				// TODO(dennwc): this will definitely fail the reverse transform
-				//               make a more specific node check when we need it
-				//               see https://github.com/bblfsh/sdk/issues/355
-				Var("body"),
-			),
-		}),
-	}))
-	return MapSemantic(typ, uast.FunctionGroup{}, MapObj(
-		// Either Body or ExpressionBody will be set.
-		CasesObj("isArrow",
-			src,
+	return MapSemantic(typ, uast.Alias{}, MapObj(
+		CasesObj("isArrowProp",
+			srcObj,
 			Objs{
-				// case 1: arrow expression
+				// case 1: accessor list
 				{
-					"Body": Is(nil),
-					"ExpressionBody": Obj{
-						uast.KeyType: String("ArrowExpressionClause"),
-						// will use this positions for Block in Body
-						uast.KeyPos: Var("arrow_pos"),
-						"ArrowToken": Obj{
-							uast.KeyType: String("EqualsGreaterThanToken"),
-							// will use this position for Return in Body
-							uast.KeyPos: Var("arrow_pos_tok"),
-							"IsMissing": Bool(false),
-							"Text":      Any(),
-							"Value":     Any(),
-							"ValueText": Any(),
-						},
-						"IsMissing":          Bool(false),
-						"IsStructuredTrivia": Bool(false),
-						"Expression":         Var("arrow"),
-					},
+					"ExpressionBody": Is(nil),
+					"AccessorList": accessorList(opAutoAccessors{
+						opAuto: Var("auto"),
+						opArr:  Var("accessors"),
+					}),
 				},
-				// case 2: full body
+				// case 2: arrow expression
 				{
-					"ExpressionBody": Is(nil),
-					"Body":           Var("body"),
+					"AccessorList":   Is(nil),
+					"ExpressionBody": arrowClause(),
 				},
 			},
 		),
+		Obj{
+			"Name": name,
+			"Node": CasesObj("isArrowProp",
+				dstObj,
+				Objs{
+					// case 1: accessor list
+					{
+						"Auto":      Var("auto"),
+						"Accessors": Var("accessors"),
+					},
+					// case 2: arrow expression
+					{
+						"Auto": Bool(false),
+						"Accessors": Arr(
+							UASTType(uast.FunctionGroup{}, Obj{
+								"Nodes": Arr(
+									UASTType(uast.Alias{}, Obj{
+										"Name": UASTType(uast.Identifier{}, Obj{
+											"Name": String("get"),
+										}),
+										"Node": UASTType(uast.Function{}, Obj{
+											"Type": UASTType(uast.FunctionType{}, Obj{}),
+											"Body": arrowBlock(),
+										}),
+									}),
+								),
+							}),
+						),
+					},
+				},
+			),
+		},
+	))
+}
 
+// eventDefMap creates an annotation structure for event declarations with custom
+// add and remove accessors.
+//
+// Similar to properties (see propertyDefMap), the event is converted to a uast:Alias that
+// binds the event name to an Event node with a list of accessors (see accessorDefMap).
+func eventDefMap() Mapping {
+	return MapSemantic("EventDeclaration", uast.Alias{}, MapObj(
 		Obj{
-			"Nodes": Arr(funcGroup...),
+			"Identifier":                 Var("name"),
+			"EventKeyword":               Var("keyword"),
+			"Type":                       Var("type"),
+			"AttributeLists":             Var("attrs"),
+			"Modifiers":                  Var("modifiers"),
+			"ExplicitInterfaceSpecifier": explicitInterface(),
+			"AccessorList":               accessorList(Var("accessors")),
+			"IsMissing":                  Bool(false),
+			"IsStructuredTrivia":         Bool(false),
+		},
+		Obj{
+			"Name": Var("name"),
+			"Node": Obj{
+				uast.KeyType: String(typeEvent),
+				"Keyword":    Var("keyword"),
+				"Type":       Var("type"),
+				"Attributes": Var("attrs"),
+				"Modifiers":  Var("modifiers"),
+				"Interface":  explicitInterfaceNode(),
+				"Accessors":  Var("accessors"),
+				// see opAttachDocs
+				"Docs": Arr(),
+			},
+		},
+	))
+}
+
+// accessorList matches an AccessorList node of properties, indexers and events.
+func accessorList(accessors Op) Op {
+	return Obj{
+		uast.KeyType:         String("AccessorList"),
+		uast.KeyPos:          Any(),
+		"OpenBraceToken":     Any(),
+		"CloseBraceToken":    Any(),
+		"IsMissing":          Bool(false),
+		"IsStructuredTrivia": Bool(false),
+		"Accessors":          accessors,
+	}
+}
+
+// typeDeclaration is a type of the node that describes class, struct, interface and enum
+// declarations in Semantic mode.
+const typeDeclaration = "TypeDeclaration"
+
+// typeDefMap creates a common annotation structure for type declarations with a specified AST type.
+//
+// The declaration is converted to a uast:Alias that binds the type name to a TypeDeclaration
+// node. Kind is set to the declaration keyword ("class", "struct", etc.) and the keyword node
+// itself is stored in a field with a specified name in the native AST.
+//
+// If generic flag is set, it will also convert type parameters and constraints of the type.
+// In other cases it will assume that there are no such fields in the native AST node (enums),
+// and will set both to empty arrays.
+func typeDefMap(typ, kind, keyword string, generic bool) Mapping {
+	src := Obj{
+		"Identifier":     Var("name"),
+		keyword:          Var("keyword"),
+		"AttributeLists": Var("attrs"),
+		"Modifiers":      Var("modifiers"),
+		"BaseList": Cases("caseBase",
+			Is(nil),
+			Obj{
+				uast.KeyType:         String("BaseList"),
+				uast.KeyPos:          Any(),
+				"ColonToken":         Any(),
+				"IsMissing":          Bool(false),
+				"IsStructuredTrivia": Bool(false),
+				"Types":              Var("bases"),
+			},
+		),
+		"Members": Var("members"),
+		// TODO(dennwc): remap to custom positional fields
+		"OpenBraceToken":     Any(),
+		"CloseBraceToken":    Any(),
+		"SemicolonToken":     Any(),
+		"IsMissing":          Bool(false),
+		"IsStructuredTrivia": Bool(false),
+	}
+	dst := Obj{
+		uast.KeyType: String(typeDeclaration),
+		"Kind":       String(kind),
+		"Keyword":    Var("keyword"),
+		"Attributes": Var("attrs"),
+		"Modifiers":  Var("modifiers"),
+		"BaseTypes": Cases("caseBase",
+			Arr(),
+			Var("bases"),
+		),
+		"Members": Var("members"),
+		// see opAttachDocs
+		"Docs": Arr(),
+	}
+	if generic {
+		// number of type parameters - safe to ignore
+		src["Arity"] = Any()
+		src["TypeParameterList"] = Cases("caseTypeParams",
+			Is(nil),
+			Obj{
+				uast.KeyType:         String("TypeParameterList"),
+				uast.KeyPos:          Any(),
+				"LessThanToken":      Any(),
+				"GreaterThanToken":   Any(),
+				"IsMissing":          Bool(false),
+				"IsStructuredTrivia": Bool(false),
+				"Parameters":         Var("typeParams"),
+			},
+		)
+		src["ConstraintClauses"] = Var("constraints")
+		dst["TypeParameters"] = Cases("caseTypeParams",
+			Arr(),
+			Var("typeParams"),
+		)
+		dst["Constraints"] = Var("constraints")
+	} else {
+		dst["TypeParameters"] = Arr()
+		dst["Constraints"] = Arr()
+	}
+	return MapSemantic(typ, uast.Alias{}, MapObj(
+		src,
+		Obj{
+			"Name": Var("name"),
+			"Node": dst,
 		},
 	))
 }
@@ -295,6 +1475,7 @@ func funcDefMap(typ string, returns bool, other Obj, toGroup ...Op) Mapping {
 // useFullSpan is a set of node types that use FullSpan for positions instead of Span
 var useFullSpan = []nodes.Value{
 	nodes.String("SingleLineDocumentationCommentTrivia"),
+	nodes.String("MultiLineDocumentationCommentTrivia"),
 }
 
 // Preprocessors is a block of AST preprocessing rules rules.
@@ -437,6 +1618,18 @@ var Preprocessors = []Mapping{
 		EndOffsetKey: "spanEnd",
 	}.Mapping(),
 
+	// Add an empty @token field to directive nodes. It will be populated from the source code
+	// to let pairDirectives parse them.
+	Map(
+		Part("_", Obj{
+			uast.KeyType: Check(In(directiveTypes...), Var("typ")),
+		}),
+		Part("_", Obj{
+			uast.KeyType:  Var("typ"),
+			uast.KeyToken: String(""),
+		}),
+	),
+
 	// Add an empty @token field to comment nodes. It's necessary to pass the check
 	// in the comment extractor.
 	Map(
@@ -466,6 +1659,15 @@ var Preprocessors = []Mapping{
 			uast.KeyToken: String(""),
 		}),
 	),
+	Map(
+		Part("_", Obj{
+			uast.KeyType: String("MultiLineDocumentationCommentTrivia"),
+		}),
+		Part("_", Obj{
+			uast.KeyType:  String("MultiLineDocumentationCommentTrivia"),
+			uast.KeyToken: String(""),
+		}),
+	),
 }
 
 // Normalizers is the main block of normalization rules to convert native AST to semantic UAST.
@@ -684,14 +1886,26 @@ var Normalizers = []Mapping{
 		CommentNode(true, uast.KeyToken, nil),
 	)),
 
-	// TODO(dennwc): differentiate from regular comments
-	MapSemantic("SingleLineDocumentationCommentTrivia", uast.Comment{}, MapObj(
+	// Documentation comments are converted to a Documentation node that keeps the
+	// uast:Comment and the parsed XML elements, see opDocComment.
+	Map(
 		Obj{
+			uast.KeyType:  String("SingleLineDocumentationCommentTrivia"),
+			uast.KeyPos:   Var("pos"),
 			uast.KeyToken: CommentText([2]string{"///", ""}, "text"),
 			"IsDirective": Bool(false),
 		},
-		CommentNode(false, "text", nil),
-	)),
+		opDocComment{CommentNode(false, "text", Var("pos"))},
+	),
+	Map(
+		Obj{
+			uast.KeyType:  String("MultiLineDocumentationCommentTrivia"),
+			uast.KeyPos:   Var("pos"),
+			uast.KeyToken: CommentText([2]string{"/**", "*/"}, "text"),
+			"IsDirective": Bool(false),
+		},
+		opDocComment{CommentNode(true, "text", Var("pos"))},
+	),
 
 	// Import (aka UsingDirectiveSyntax) is more or less trivial.
 	//
@@ -807,14 +2021,17 @@ var Normalizers = []Mapping{
 	)),
 
 	// Old style multiple arguments: argument with the magic name "__arglist"
-	MapSemantic("Parameter", uast.Argument{}, MapObj(
+	paramDefMap(
 		Obj{
 			"Identifier": Check(
 				Has{
 					uast.KeyType: String(uast.TypeOf(uast.Identifier{})),
 					"Name":       String("__arglist"),
 				}, Var("name")),
-			"AttributeLists":     Arr(), // TODO(dennwc): any cases when it's not empty?
+			"AttributeLists": opArrNotEmpty{
+				opHas: Var("has_attrs"),
+				opArr: Var("attrs"),
+			},
 			"Default":            Var("def_init"),
 			"IsMissing":          Bool(false),
 			"IsStructuredTrivia": Bool(false),
@@ -829,15 +2046,19 @@ var Normalizers = []Mapping{
 			"MapVariadic": Bool(false),
 			"Receiver":    Bool(false),
 		},
-	)),
+	),
 
 	// Normal parameter, potential multiple args expressed by "params" in modifiers
-	MapSemantic("Parameter", uast.Argument{}, MapObj(
+	paramDefMap(
 		Obj{
 			"Identifier": Check(Has{
 				uast.KeyType: String(uast.TypeOf(uast.Identifier{})),
 			}, Var("name")),
-			"AttributeLists":     Arr(), // TODO(dennwc): any cases when it's not empty?
+			// [CallerMemberName], [FromBody], etc
+			"AttributeLists": opArrNotEmpty{
+				opHas: Var("has_attrs"),
+				opArr: Var("attrs"),
+			},
 			"Default":            Var("def_init"),
 			"IsMissing":          Bool(false),
 			"IsStructuredTrivia": Any(),
@@ -847,7 +2068,7 @@ var Normalizers = []Mapping{
 				opRest: opArrHasKeyword{
 					keyword: "ThisKeyword",
 					opHas:   Var("this"),
-					opRest:  Var("rest"),
+					opRest:  opByRefModifiers{Var("byref")},
 				},
 			},
 			"Type": Var("type"),
@@ -855,7 +2076,7 @@ var Normalizers = []Mapping{
 		Obj{
 			"Name": Var("name"),
 			"Type": opArrToChain{
-				opMods: Var("rest"),
+				opMods: Var("byref"),
 				opType: Var("type"),
 			},
 			"Init":        Var("def_init"),
@@ -863,83 +2084,86 @@ var Normalizers = []Mapping{
 			"MapVariadic": Bool(false),
 			"Receiver":    Var("this"),
 		},
-	)),
+	),
 
-	funcDefMap("MethodDeclaration", true,
-		Obj{
+	funcDefMap("MethodDeclaration", "ReturnType",
+		genericFunc(Obj{
 			// number of parameters - safe to ignore
 			"Arity":                      Any(),
-			"ExplicitInterfaceSpecifier": Is(nil),
-			"ConstraintClauses": Cases("caseConstraint",
-				Arr(),
-				NotEmpty(Var("constraints")),
-			),
-			"TypeParameterList": Cases("caseTypeParams",
-				Is(nil),
-				Arr(),
-				NotEmpty(Var("typeParams")),
-			),
-		},
-		Cases("caseTypeParams",
-			Is(nil),
-			Is(nil),
-			NotEmpty(Var("typeParams")),
-		),
-		Cases("caseConstraint",
-			Is(nil),
-			NotEmpty(Var("constraints")),
-		),
+			"ExplicitInterfaceSpecifier": explicitInterface(),
+		}),
+		append(genericFuncGroup(), explicitInterfaceNode())...,
+	),
+	// LocalFunctionStatement is a function declared inside other function.
+	// It is similar to MethodDeclaration, but cannot implement interfaces.
+	funcDefMap("LocalFunctionStatement", "ReturnType",
+		genericFunc(Obj{
+			// not supported by Roslyn version we use
+			"AttributeLists": nil,
+		}),
+		genericFuncGroup()...,
 	),
 	// ConstructorDeclaration is similar to MethodDeclaration, but it may include a
-	// base class initializer that require a special transformation.
+	// base class or this initializer that require a special transformation.
 	MapSemantic("ConstructorDeclaration", uast.FunctionGroup{}, MapObj(
-		Obj{
-			// Same as to MethodDeclaration above
-			"Identifier": Var("name"),
-			"ParameterList": Obj{
-				uast.KeyType:         String("ParameterList"),
-				uast.KeyPos:          Any(),
-				"OpenParenToken":     Any(),
-				"CloseParenToken":    Any(),
+		CasesObj("isArrow",
+			Obj{
+				// Same as to MethodDeclaration above
+				"Identifier":         Var("name"),
+				"ParameterList":      paramList(),
 				"IsMissing":          Bool(false),
 				"IsStructuredTrivia": Bool(false),
-				"Parameters":         Var("params"),
-			},
-			"IsMissing":          Bool(false),
-			"IsStructuredTrivia": Bool(false),
-			"SemicolonToken":     Any(),
-			"AttributeLists": Cases("caseAttrs",
-				Arr(),
-				Check(OfKind(nodes.KindArray), Var("attr")),
-				Check(OfKind(nodes.KindObject), Var("attr")),
-			),
+				"SemicolonToken":     Any(),
+				"AttributeLists": Cases("caseAttrs",
+					Arr(),
+					Check(OfKind(nodes.KindArray), Var("attr")),
+					Check(OfKind(nodes.KindObject), Var("attr")),
+				),
 
-			// won't be set for a constructor
-			"ExpressionBody": Is(nil),
-
-			// Initializer is an expression to initialize the base class.
-			// Here we consider case if it's exists in the AST node.
-			//
-			// Initializer is basically a function call that will init the base class.
-			// So we will consider it a first statement of a function body.
-			//
-			// For this we dig into Body above to get the list of statements.
-			// If hasBaseInit is set (initializer exists), we will prepend it
-			// to the array of statement in Body.
-			"Initializer": If("hasBaseInit",
-				// case 1: has base initializer
-				Check(HasType("BaseConstructorInitializer"), Var("baseInit")),
-				// case 2: no initializer
-				Is(nil),
-			),
-			"Body": Part("bodyMap", Obj{
-				"Statements": Var("stmts"),
-			}),
-			"Modifiers": Cases("caseMods",
-				Arr(),
-				NotEmpty(Var("modifiers")),
-			),
-		},
+				// Initializer is an expression to initialize the base class,
+				// or to call another constructor of the same class.
+				// Here we consider case if it's exists in the AST node.
+				//
+				// Initializer is basically a function call that will init the base class.
+				// So we will consider it a first statement of a function body.
+				//
+				// For this we dig into Body below to get the list of statements.
+				// If hasInit is set (initializer exists), we will prepend it
+				// to the array of statement in Body.
+				"Initializer": If("hasInit",
+					// case 1: has base or this initializer
+					Check(Has{uast.KeyType: In(
+						nodes.String("BaseConstructorInitializer"),
+						nodes.String("ThisConstructorInitializer"),
+					)}, Var("init")),
+					// case 2: no initializer
+					Is(nil),
+				),
+				// static constructors are flagged in the Constructor node, see below
+				"Modifiers": opArrContainsKeyword{
+					keyword: "StaticKeyword",
+					opHas:   Var("static"),
+					opArr: Cases("caseMods",
+						Arr(),
+						NotEmpty(Var("modifiers")),
+					),
+				},
+			},
+			Objs{
+				// case 1: arrow expression
+				{
+					"Body":           Is(nil),
+					"ExpressionBody": arrowClause(),
+				},
+				// case 2: full body
+				{
+					"ExpressionBody": Is(nil),
+					"Body": Part("bodyMap", Obj{
+						"Statements": Var("stmts"),
+					}),
+				},
+			},
+		),
 		Obj{
 			"Nodes": Arr(
 				Cases("caseAttrs",
@@ -951,31 +2175,88 @@ var Normalizers = []Mapping{
 					Is(nil),
 					NotEmpty(Var("modifiers")),
 				),
+				Obj{
+					uast.KeyType: String(typeConstructor),
+					"Static":     Var("static"),
+				},
 				UASTType(uast.Alias{}, Obj{
 					"Name": Var("name"),
 					"Node": UASTType(uast.Function{}, Obj{
 						// Restore the function body.
 						//
-						// We will also prepend a base class initializer here, see above.
-						"Body": Part("bodyMap", Obj{
-							"Statements": If("hasBaseInit",
-								// case 1: has base initializer
-								PrependOne(Var("baseInit"), Var("stmts")),
-								// case 2: no initializer
-								Var("stmts"),
-							),
-						}),
+						// We will also prepend an initializer here, see above.
+						"Body": Cases("isArrow",
+							// case 1: arrow expression
+							UASTType(uast.Block{}, Obj{
+								uast.KeyPos:  Var("arrow_pos"),
+								"Statements": ctorInitStmts(Arr(arrowReturn())),
+							}),
+							// case 2: full body
+							Part("bodyMap", Obj{
+								"Statements": ctorInitStmts(Var("stmts")),
+							}),
+						),
 						"Type": UASTType(uast.FunctionType{}, Obj{
 							"Arguments": Var("params"),
+							"Returns":   Var("outs"),
 						}),
 					}),
 				}),
 			),
 		},
 	)),
-	funcDefMap("DestructorDeclaration", false, Obj{
+	funcDefMap("DestructorDeclaration", "", Obj{
 		"TildeToken": Any(),
 	}),
+	// Operators are converted to a FunctionGroup with a name that matches the name
+	// of the operator method in CLR metadata, see opOperatorName.
+	funcDefMapNamed("OperatorDeclaration", "ReturnType",
+		opOperatorName{
+			token:  Var("op_token"),
+			params: Var("params"),
+		},
+		Obj{
+			"OperatorKeyword": Var("op_kw"),
+			"OperatorToken":   Var("op_token"),
+		},
+		Var("op_kw"),
+	),
+	funcDefMapNamed("ConversionOperatorDeclaration", "Type",
+		opOperatorName{
+			token:  Var("op_token"),
+			params: Var("params"),
+		},
+		Obj{
+			"OperatorKeyword":           Var("op_kw"),
+			"ImplicitOrExplicitKeyword": Var("op_token"),
+		},
+		Var("op_kw"),
+	),
+
+	// Lambdas and anonymous methods are converted to an anonymous uast:Function,
+	// see lambdaDefMap.
+	lambdaDefMap("SimpleLambdaExpression", false, simpleLambda, simpleLambdaType, lambdaBodies),
+	lambdaDefMap("SimpleLambdaExpression", true, simpleLambda, simpleLambdaType, lambdaBodies),
+	lambdaDefMap("ParenthesizedLambdaExpression", false, parenLambda, parenLambdaType, lambdaBodies),
+	lambdaDefMap("ParenthesizedLambdaExpression", true, parenLambda, parenLambdaType, lambdaBodies),
+	lambdaDefMap("AnonymousMethodExpression", false, anonMethod, anonMethodType, anonMethodBody),
+	lambdaDefMap("AnonymousMethodExpression", true, anonMethod, anonMethodType, anonMethodBody),
+
+	// Properties, indexers and events are converted to a node with a list of accessor
+	// functions, see propertyDefMap, indexerDefMap, eventDefMap and accessorDefMap.
+	accessorDefMap("GetAccessorDeclaration", "get"),
+	accessorDefMap("SetAccessorDeclaration", "set"),
+	accessorDefMap("AddAccessorDeclaration", "add"),
+	accessorDefMap("RemoveAccessorDeclaration", "remove"),
+	propertyDefMap(),
+	indexerDefMap(),
+	eventDefMap(),
+
+	// Type declarations are converted to a common TypeDeclaration node, see typeDefMap.
+	typeDefMap("ClassDeclaration", "class", "Keyword", true),
+	typeDefMap("StructDeclaration", "struct", "Keyword", true),
+	typeDefMap("InterfaceDeclaration", "interface", "Keyword", true),
+	typeDefMap("EnumDeclaration", "enum", "EnumKeyword", false),
 
 	// Merge uast:Group with uast:FunctionGroup.
 	Map(
@@ -1022,6 +2303,10 @@ func (op dropNils) Construct(st *State, n nodes.Node) (nodes.Node, error) {
 var (
 	typeGroup     = uast.TypeOf(uast.Group{})
 	typeFuncGroup = uast.TypeOf(uast.FunctionGroup{})
+	typeAlias     = uast.TypeOf(uast.Alias{})
+	typeArgument  = uast.TypeOf(uast.Argument{})
+	typeIdent     = uast.TypeOf(uast.Identifier{})
+	typeQualIdent = uast.TypeOf(uast.QualifiedIdentifier{})
 )
 
 // triviaField specified a field with an array to put trivias into.
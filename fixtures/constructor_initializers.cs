@@ -0,0 +1,26 @@
+using System;
+
+public class Point : Base
+{
+    private static readonly Point origin;
+    private int x, y;
+
+    static Point()
+    {
+        origin = new Point();
+    }
+
+    public Point() : this(0, 0)
+    {
+    }
+
+    public Point(int x) : this(x, 0) => Console.WriteLine(x);
+
+    public Point(int x, int y) : base(x + y)
+    {
+        this.x = x;
+        this.y = y;
+    }
+
+    public Point(string s) => x = int.Parse(s);
+}
@@ -0,0 +1,37 @@
+using System;
+
+namespace Docs
+{
+    /// <summary>
+    /// A queue of <see cref="T:System.String"/> items.
+    /// </summary>
+    /// <remarks>See <see cref="Push(string)">Push</see> for details.</remarks>
+    /// <seealso cref="System.Collections.Generic.Queue{T}"/>
+    [Serializable]
+    public sealed class Queue
+    {
+        /// <summary>Number of items.</summary>
+        /// <value>Always non-negative.</value>
+        public int Count { get; private set; }
+
+        /// <summary>Adds <paramref name="item"/> to the queue.</summary>
+        /// <param name="item">The item to add.</param>
+        /// <returns><see langword="true"/> if the item was added.</returns>
+        /// <exception cref="ArgumentNullException">
+        ///   <paramref name="item"/> is null.
+        /// </exception>
+        /// <seealso href="https://example.com/queue"/>
+        [Obsolete]
+        public bool Push(string item)
+        {
+            if (item == null)
+                throw new ArgumentNullException(nameof(item));
+            Count++;
+            return true;
+        }
+
+        /// <summary>Converts the value.</summary>
+        /// <typeparam name="T">Target type.</typeparam>
+        T Convert<T>(object v) => (T)v;
+    }
+}
@@ -0,0 +1,19 @@
+using System;
+
+/**
+ * <summary>Parses values.</summary>
+ * <remarks>Uses <see cref="int.Parse(string)"/>.</remarks>
+ */
+static class Parser
+{
+    /** <summary>Parses <paramref name="s"/>.</summary>
+        <param name="s">Input string.</param>
+        <returns>The parsed value.</returns>
+        <exception cref="FormatException">Invalid input.</exception> */
+    public static int Parse(string s) => int.Parse(s);
+
+    /**
+     * Not a structured comment.
+     */
+    public static int Zero() => 0;
+}
@@ -0,0 +1,33 @@
+using System;
+using System.Collections;
+using System.Collections.Generic;
+
+interface IFoo
+{
+    int Get();
+}
+
+class Explicit : IDisposable, IFoo, IEnumerable<int>
+{
+    void IDisposable.Dispose() { }
+
+    int IFoo.Get() => 1;
+
+    IEnumerator IEnumerable.GetEnumerator() => null;
+
+    IEnumerator<int> IEnumerable<int>.GetEnumerator() => null;
+
+    void System.IDisposable.Dispose() { }
+}
+
+interface IPair<TKey, TValue>
+{
+    TValue Get(TKey key);
+}
+
+class ExplicitGeneric : IPair<string, int[]>, IComparer<int?>
+{
+    int[] IPair<string, int[]>.Get(string key) => null;
+
+    int System.Collections.Generic.IComparer<int?>.Compare(int? x, int? y) => 0;
+}
@@ -0,0 +1,44 @@
+using System;
+using System.Collections.Generic;
+
+interface IShape
+{
+    int Sides { get; }
+    string this[int i] { get; }
+    event EventHandler Changed;
+}
+
+interface ISized<T>
+{
+    T Size { get; set; }
+    T this[T key] { get; }
+}
+
+class Square : IShape, ISized<long>, System.ComponentModel.INotifyPropertyChanged
+{
+    private long size;
+
+    int IShape.Sides => 4;
+
+    string IShape.this[int i] => "side";
+
+    event EventHandler IShape.Changed
+    {
+        add { }
+        remove { }
+    }
+
+    long ISized<long>.Size
+    {
+        get { return size; }
+        set { size = value; }
+    }
+
+    long ISized<long>.this[long key] => key * size;
+
+    event System.ComponentModel.PropertyChangedEventHandler System.ComponentModel.INotifyPropertyChanged.PropertyChanged
+    {
+        add { }
+        remove { }
+    }
+}
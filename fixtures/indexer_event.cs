@@ -0,0 +1,40 @@
+using System;
+using System.Collections.Generic;
+
+interface IStore
+{
+    string this[int i] { get; }
+    event EventHandler Changed;
+}
+
+class Store : IStore
+{
+    private readonly List<string> items = new List<string>();
+    private EventHandler changed;
+
+    public string this[int i]
+    {
+        get { return items[i]; }
+        set
+        {
+            items[i] = value;
+            changed?.Invoke(this, EventArgs.Empty);
+        }
+    }
+
+    public string this[string key, int start = 0] => items.Find(s => s.StartsWith(key));
+
+    string IStore.this[int i] => items[i];
+
+    public event EventHandler Changed
+    {
+        add { changed += value; }
+        remove { changed -= value; }
+    }
+
+    event EventHandler IStore.Changed
+    {
+        add => Changed += value;
+        remove => Changed -= value;
+    }
+}
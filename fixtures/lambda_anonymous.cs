@@ -0,0 +1,18 @@
+using System;
+using System.Linq;
+using System.Threading.Tasks;
+
+class Lambdas
+{
+    static void Main(string[] args)
+    {
+        var evens = args.Select(s => s.Length).Where(n => n % 2 == 0);
+        Func<int, int, int> add = (int a, int b) => a + b;
+        Func<int, int> twice = (x) => { return x * 2; };
+        Func<Task<int>> load = async () => await Task.FromResult(42);
+        Func<string, Task> print = async s => { await Task.Delay(1); Console.WriteLine(s); };
+        Action any = delegate { Console.WriteLine("any"); };
+        Func<int, bool> odd = delegate (int n) { return n % 2 == 1; };
+        Func<Task> wait = async delegate { await Task.Yield(); };
+    }
+}
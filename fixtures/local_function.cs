@@ -0,0 +1,32 @@
+using System;
+using System.Collections.Generic;
+using System.Threading.Tasks;
+
+class LocalFunctions
+{
+    static async Task<int> Run(int[] values)
+    {
+        int Square(int x) => x * x;
+
+        T First<T>(IEnumerable<T> items) where T : class
+        {
+            foreach (var item in items)
+                return item;
+            return null;
+        }
+
+        async Task<int> Load()
+        {
+            await Task.Delay(1);
+            return Square(values.Length);
+        }
+
+        bool TryGet(int i, out int value)
+        {
+            value = values[i];
+            return true;
+        }
+
+        return await Load();
+    }
+}
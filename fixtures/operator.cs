@@ -0,0 +1,38 @@
+using System;
+
+public struct Money
+{
+    private readonly decimal amount;
+
+    public Money(decimal amount)
+    {
+        this.amount = amount;
+    }
+
+    public static Money operator +(Money a, Money b)
+    {
+        return new Money(a.amount + b.amount);
+    }
+
+    public static Money operator -(Money a) => new Money(-a.amount);
+
+    public static Money operator -(Money a, Money b) => new Money(a.amount - b.amount);
+
+    public static bool operator ==(Money a, Money b) => a.amount == b.amount;
+
+    public static bool operator !=(Money a, Money b) => !(a == b);
+
+    public static bool operator true(Money a) => a.amount != 0;
+
+    public static bool operator false(Money a) => a.amount == 0;
+
+    public static Money operator ++(Money a) => new Money(a.amount + 1);
+
+    public static implicit operator decimal(Money m) => m.amount;
+
+    [Obsolete]
+    public static explicit operator Money(decimal d)
+    {
+        return new Money(d);
+    }
+}
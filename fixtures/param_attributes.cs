@@ -0,0 +1,17 @@
+using System;
+using System.Runtime.CompilerServices;
+
+class ParamAttributes
+{
+    public void Log(string message, [CallerMemberName] string name = "")
+    {
+    }
+
+    public void Post([FromBody] Dto body, [NotNull, Required] string id)
+    {
+    }
+
+    public ParamAttributes([In] int x)
+    {
+    }
+}
@@ -0,0 +1,28 @@
+#define TRACE_ON
+#undef LEGACY
+using System;
+
+#region Platform
+static class Platform
+{
+#if NETCOREAPP && !(NET45 || NET46) // modern runtimes
+    public static string Name() => "core";
+#elif NETFRAMEWORK == true
+    public static string Name() => "framework";
+#else
+    public static string Name() => "unknown";
+#endif
+
+    public static void Log(string s)
+    {
+#pragma warning disable CS0168, CS0219
+        int unused;
+#pragma warning restore CS0168
+#if DEBUG
+#if TRACE_ON
+        Console.WriteLine(s);
+#endif
+#endif
+    }
+}
+#endregion
@@ -0,0 +1,27 @@
+using System;
+
+abstract class Properties
+{
+    private int _x;
+
+    public int Auto { get; set; }
+
+    public int AutoInit { get; private set; } = 42;
+
+    public string ReadOnly => "value";
+
+    public int Full
+    {
+        get { return _x; }
+        set { _x = value; }
+    }
+
+    public int Arrow
+    {
+        get => _x;
+        set => _x = value;
+    }
+
+    [Obsolete]
+    public abstract int Abstract { get; }
+}
@@ -0,0 +1,14 @@
+using System
+
+class Broken
+{
+    void F(int a
+    {
+        var x = ;
+        G(a
+    }
+
+    public int H() { return 1 }
+
+    void
+}
@@ -0,0 +1,28 @@
+using System;
+
+static class RefOutParams
+{
+    public static bool TryParse(string s, out int value, out bool negative)
+    {
+        value = 0;
+        negative = false;
+        return true;
+    }
+
+    public static void Swap<T>(ref T a, ref T b)
+    {
+        T t = a;
+        a = b;
+        b = t;
+    }
+
+    public static int Sum(in int a, [In] ref int b, params int[] rest)
+    {
+        return a + b;
+    }
+
+    public static void Fill(this int[] arr, [Out] out int count)
+    {
+        count = arr.Length;
+    }
+}
@@ -7,5 +7,6 @@ require (
 	github.com/opencontainers/runc v1.1.14 // indirect
 	github.com/uber/jaeger-client-go v2.16.0+incompatible // indirect
 	github.com/uber/jaeger-lib v2.0.0+incompatible // indirect
-	google.golang.org/grpc v1.56.3 // indirect
+	google.golang.org/grpc v1.56.3
+	gopkg.in/src-d/go-errors.v1 v1.0.0
 )
@@ -1,70 +1,643 @@
 using System;
+using System.IO;
 using System.Linq;
+using System.Text;
 using System.Collections.Generic;
 
 using Newtonsoft.Json;
 using Newtonsoft.Json.Serialization;
 using Microsoft.CodeAnalysis;
 using Microsoft.CodeAnalysis.CSharp;
+using Microsoft.CodeAnalysis.CSharp.Syntax;
+using Microsoft.CodeAnalysis.Text;
 
 namespace native
 {
     public class ParseRequest
     {
         public string content;
+        // preprocessor symbols defined for the file
+        public List<string> symbols;
+        // C# language version, as in LangVersion project property; default if empty
+        public string languageVersion;
+        // if set, the request is a handshake that selects the wire format of the responses
+        public string format;
+        // if set, the request is a handshake that selects the AST schema: "full" or "lean"
+        public string schema;
+        // if set, the syntax tree is kept for incremental reparsing of the document with this id
+        public string document;
+        // changes of the document text since the last request; if set, the content is ignored
+        // and the previous tree of the document is reparsed incrementally
+        public List<TextEdit> edits;
+        // if set, the document is closed and its syntax tree is discarded
+        public bool close;
+        // if set, the request is a batch: each file is parsed with the options of the request,
+        // and a separate response is written for each file, in the same order
+        public List<BatchFile> files;
+        // maximal size of the serialized response in bytes; if the response is larger, it's
+        // replaced with a response with the "tooLarge" status (see TooLarge); no limit if zero
+        public int maxSize;
+    }
+
+    public class BatchFile
+    {
+        public string path;
+        public string content;
+    }
+
+    public class TextEdit
+    {
+        // UTF-16 offsets of the replaced span in the previous text of the document
+        public int start;
+        public int end;
+        public string text;
     }
 
     public class ParseResponse
     {
+        // path of the file from the batch request
+        public string path;
         public string status;
         public List<string> errors;
         public Object ast;
+        // effective C# language version used to parse the file
+        public string languageVersion;
+        // syntax errors and warnings reported by the parser
+        public List<ParseDiagnostic> diagnostics;
+        // wire format selected by the handshake request
+        public string format;
+        // AST schema selected by the handshake request
+        public string schema;
+        // values of fields omitted from the AST in the lean schema, by node type
+        // note that it must be the last field, since it's filled when the AST is serialized
+        public Dictionary<string, Dictionary<string, object>> defaults;
+    }
+
+    // ReusedNode is sent instead of a member that is the same as in the previous tree of the document.
+    public class ReusedNode
+    {
+        // full span of the member in the previous tree
+        public int Start;
+        public int Length;
+        // the difference between new and old positions of the member
+        public int Shift;
+    }
+
+    public class ParseDiagnostic
+    {
+        // diagnostic id, for example CS1002
+        public string id;
+        // Error or Warning
+        public string severity;
+        public string message;
+        // UTF-16 offsets of the diagnostic span
+        public int start;
+        public int end;
     }
 
     class Program
     {
         static void Main(string[] args)
         {
-            var jsonSerializerSettings = new JsonSerializerSettings
+            var reused = new ReusedNodes();
+            var fullSerializer = NewSerializer(new ASTContractResolver(null, reused));
+            var leanSchema = new LeanSchema();
+            var leanSerializer = NewSerializer(new ASTContractResolver(leanSchema, reused));
+
+            // responses are written as JSON lines with the full AST schema by default;
+            // the client may switch to a more compact MessagePack encoding and to the lean
+            // schema with a handshake request (see Negotiate)
+            var stdout = Console.OpenStandardOutput();
+            bool binary = false;
+            bool lean = false;
+
+            void write(ParseResponse resp, int maxSize)
+            {
+                // serialize to a buffer first, so a serialization error won't leave
+                // a partial response in the output stream
+                var serializer = fullSerializer;
+                if (lean && resp.ast != null)
+                {
+                    serializer = leanSerializer;
+                    resp.defaults = leanSchema.Reset();
+                }
+                byte[] output;
+                try
+                {
+                    output = Serialize(serializer, resp, binary);
+                }
+                catch (Exception e)
+                {
+                    output = Serialize(fullSerializer, Fatal(e), binary);
+                }
+                // the length prefix of MessagePack frames is not counted, the same way as the driver does
+                int size = binary ? output.Length - 4 : output.Length;
+                if (maxSize > 0 && size > maxSize)
+                {
+                    output = Serialize(fullSerializer, TooLarge(resp, maxSize), binary);
+                }
+                stdout.Write(output, 0, output.Length);
+                stdout.Flush();
+            }
+
+            string line;
+            while ((line = Console.ReadLine()) != null)
+            {
+                ParseRequest req = null;
+                ParseResponse resp;
+                reused.Reset();
+                try
+                {
+                    req = JsonConvert.DeserializeObject<ParseRequest>(line);
+                    if (req != null && req.files != null)
+                    {
+                        // responses are written for each file
+                        resp = null;
+                    }
+                    else if (req != null && (req.format != null || req.schema != null))
+                    {
+                        resp = Negotiate(req);
+                    }
+                    else if (req != null && req.document != null)
+                    {
+                        resp = ParseDocument(req, reused);
+                    }
+                    else
+                    {
+                        resp = Parse(req);
+                    }
+                }
+                catch (Exception e)
+                {
+                    resp = Fatal(e);
+                }
+                if (resp == null)
+                {
+                    foreach (var f in req.files)
+                    {
+                        try
+                        {
+                            resp = Parse(f == null ? null : new ParseRequest
+                            {
+                                content = f.content,
+                                symbols = req.symbols,
+                                languageVersion = req.languageVersion,
+                            });
+                        }
+                        catch (Exception e)
+                        {
+                            resp = Fatal(e);
+                        }
+                        resp.path = f?.path;
+                        write(resp, req.maxSize);
+                    }
+                    continue;
+                }
+                write(resp, req == null ? 0 : req.maxSize);
+
+                // the handshake response is still written in the previous format
+                if (resp.format != null)
+                {
+                    binary = resp.format == FormatMsgpack;
+                }
+                if (resp.schema != null)
+                {
+                    lean = resp.schema == SchemaLean;
+                }
+            }
+        }
+
+        static JsonSerializer NewSerializer(IContractResolver resolver)
+        {
+            return JsonSerializer.Create(new JsonSerializerSettings
             {
                 PreserveReferencesHandling = PreserveReferencesHandling.None,
                 // ignore loops
                 ReferenceLoopHandling = ReferenceLoopHandling.Ignore,
                 // controls how individual fields are converted
-                ContractResolver = new ASTContractResolver(),
-            };
-            var jsonSerializer = JsonSerializer.Create(jsonSerializerSettings);
-            var jsonWriter = new JsonTextWriter(Console.Out);
+                ContractResolver = resolver,
+            });
+        }
 
-            string line;
-            while ((line = Console.ReadLine()) != null)
+        const string FormatJSON = "json";
+        const string FormatMsgpack = "msgpack";
+
+        const string SchemaFull = "full";
+        const string SchemaLean = "lean";
+
+        // Negotiate handles a handshake request that selects the wire format and the AST schema.
+        static ParseResponse Negotiate(ParseRequest req)
+        {
+            var errors = new List<string>();
+            if (req.format != null && req.format != FormatJSON && req.format != FormatMsgpack)
+            {
+                errors.Add("unsupported wire format: " + req.format);
+            }
+            if (req.schema != null && req.schema != SchemaFull && req.schema != SchemaLean)
+            {
+                errors.Add("unsupported schema: " + req.schema);
+            }
+            if (errors.Count != 0)
+            {
+                return new ParseResponse { status = "fatal", errors = errors };
+            }
+            return new ParseResponse { status = "ok", format = req.format, schema = req.schema };
+        }
+
+        // Parse parses the source file from the request.
+        static ParseResponse Parse(ParseRequest req)
+        {
+            if (req == null)
+            {
+                throw new ArgumentException("empty request");
+            }
+            CSharpParseOptions options;
+            if (!TryParseOptions(req, out options))
+            {
+                return new ParseResponse
+                {
+                    status = "fatal",
+                    errors = new List<string> { "unsupported language version: " + req.languageVersion },
+                };
+            }
+            SyntaxTree tree = CSharpSyntaxTree.ParseText(req.content ?? "", options);
+            var resp = new ParseResponse
             {
-                // TODO(dennwc): handle exceptions and syntax errors
-                ParseRequest req = JsonConvert.DeserializeObject<ParseRequest>(line);
+                status = "ok",
+                ast = tree.GetRoot(),
+                languageVersion = options.LanguageVersion.ToDisplayString(),
+            };
+            AddDiagnostics(resp, tree);
+            return resp;
+        }
 
-                Object ast = Parse(req.content);
+        // OpenDocument is a syntax tree of the document that is parsed incrementally.
+        //
+        // Documents are kept until the driver closes them. The driver limits the number of open
+        // documents and closes documents that are not used, thus the parser doesn't evict them.
+        class OpenDocument
+        {
+            public SyntaxTree tree;
+        }
 
-                ParseResponse resp = new ParseResponse
+        // documents are open documents, by id
+        static Dictionary<string, OpenDocument> documents = new Dictionary<string, OpenDocument>();
+
+        // ParseDocument parses the document and keeps its syntax tree for the following requests.
+        //
+        // If the request has edits, the previous tree of the document is reparsed incrementally.
+        // Members that are the same as in the previous tree are sent as ReusedNode (see ReusedNodes).
+        // If the document is not open, for example because the parser was restarted, the "unknownDocument"
+        // status is returned, and the client must send the whole text of the document.
+        static ParseResponse ParseDocument(ParseRequest req, ReusedNodes reused)
+        {
+            if (req.close)
+            {
+                documents.Remove(req.document);
+                return new ParseResponse { status = "ok" };
+            }
+            if (req.edits == null)
+            {
+                // remove the tree first, so it won't be used if the parse fails
+                documents.Remove(req.document);
+                var resp = Parse(req);
+                if (resp.ast != null)
                 {
-                    status = "ok",
-                    ast = ast,
+                    AddDocument(req.document, ((SyntaxNode)resp.ast).SyntaxTree);
+                }
+                return resp;
+            }
+            OpenDocument doc;
+            if (!documents.TryGetValue(req.document, out doc))
+            {
+                return new ParseResponse
+                {
+                    status = "unknownDocument",
+                    errors = new List<string> { "unknown document: " + req.document },
                 };
-                jsonSerializer.Serialize(jsonWriter, resp);
-                jsonWriter.WriteWhitespace("\n");
-                jsonWriter.Flush();
             }
+            documents.Remove(req.document);
+
+            var old = doc.tree;
+            var changes = req.edits.Select(e => new TextChange(TextSpan.FromBounds(e.start, e.end), e.text ?? ""));
+            SyntaxTree tree = old.WithChangedText(old.GetText().WithChanges(changes));
+            AddDocument(req.document, tree);
+            reused.Set(old.GetRoot(), req.edits);
+
+            var r = new ParseResponse
+            {
+                status = "ok",
+                ast = tree.GetRoot(),
+                languageVersion = ((CSharpParseOptions)tree.Options).LanguageVersion.ToDisplayString(),
+            };
+            AddDiagnostics(r, tree);
+            return r;
+        }
+
+        // AddDocument stores the syntax tree of the document.
+        static void AddDocument(string id, SyntaxTree tree)
+        {
+            documents[id] = new OpenDocument { tree = tree };
+        }
+
+        // Fatal returns a response for a request that failed with an exception.
+        static ParseResponse Fatal(Exception e)
+        {
+            return new ParseResponse
+            {
+                status = "fatal",
+                errors = new List<string> { e.GetType().Name + ": " + e.Message },
+            };
+        }
+
+        // TooLarge returns a response that replaces the response exceeding the size limit.
+        // The AST is dropped, thus the client doesn't need to read it.
+        static ParseResponse TooLarge(ParseResponse resp, int maxSize)
+        {
+            return new ParseResponse
+            {
+                path = resp.path,
+                status = "tooLarge",
+                errors = new List<string> { "native AST is larger than " + maxSize + " bytes" },
+            };
+        }
+
+        // Serialize encodes the response either as a single JSON line,
+        // or as a MessagePack value prefixed with its length.
+        static byte[] Serialize(JsonSerializer serializer, ParseResponse resp, bool binary)
+        {
+            if (binary)
+            {
+                var w = new MessagePackWriter();
+                serializer.Serialize(w, resp);
+                return w.ToFrame();
+            }
+            var buf = new StringWriter();
+            serializer.Serialize(new JsonTextWriter(buf), resp);
+            buf.Write("\n");
+            return Encoding.UTF8.GetBytes(buf.ToString());
+        }
+
+        static bool TryParseOptions(ParseRequest req, out CSharpParseOptions options)
+        {
+            options = CSharpParseOptions.Default;
+            if (req.symbols != null)
+            {
+                options = options.WithPreprocessorSymbols(req.symbols);
+            }
+            if (!String.IsNullOrEmpty(req.languageVersion))
+            {
+                LanguageVersion version;
+                if (!LanguageVersionFacts.TryParse(req.languageVersion, out version))
+                {
+                    return false;
+                }
+                options = options.WithLanguageVersion(version);
+            }
+            return true;
+        }
+
+        // AddDiagnostics adds syntax errors and warnings to the response.
+        // The status is not changed: the tree is still returned, since Roslyn recovers from syntax errors.
+        static void AddDiagnostics(ParseResponse resp, SyntaxTree tree)
+        {
+            foreach (var d in tree.GetDiagnostics())
+            {
+                if (d.Severity != DiagnosticSeverity.Error && d.Severity != DiagnosticSeverity.Warning)
+                {
+                    continue;
+                }
+                if (resp.diagnostics == null)
+                {
+                    resp.diagnostics = new List<ParseDiagnostic>();
+                }
+                resp.diagnostics.Add(new ParseDiagnostic
+                {
+                    id = d.Id,
+                    severity = d.Severity.ToString(),
+                    message = d.GetMessage(),
+                    start = d.Location.SourceSpan.Start,
+                    end = d.Location.SourceSpan.End,
+                });
+            }
+        }
+    }
+
+    // LeanSchema records values of fields omitted from the AST in the lean schema.
+    //
+    // The lean schema omits the following fields:
+    //  - IsMissing, IsStructuredTrivia, IsVar, IsUnmanaged and Arity with a default value;
+    //    the values are reported in the "defaults" field of the response, by node type;
+    //  - Value and ValueText of tokens, if they are the same as Text;
+    //  - whitespace and end of line trivia.
+    class LeanSchema
+    {
+        Dictionary<string, Dictionary<string, object>> _defaults;
+
+        // Reset starts recording default values for a new AST.
+        public Dictionary<string, Dictionary<string, object>> Reset()
+        {
+            _defaults = new Dictionary<string, Dictionary<string, object>>();
+            return _defaults;
+        }
+
+        public void Add(string type, string field, object value)
+        {
+            Dictionary<string, object> fields;
+            if (!_defaults.TryGetValue(type, out fields))
+            {
+                fields = new Dictionary<string, object>();
+                _defaults[type] = fields;
+            }
+            fields[field] = value;
+        }
+
+        public static bool IsDefault(object v)
+        {
+            return (v is bool && !(bool)v) || (v is int && (int)v == 0);
+        }
+    }
+
+    // LeanTriviaConverter writes trivia lists without whitespace and end of line trivia.
+    class LeanTriviaConverter : JsonConverter
+    {
+        public override bool CanConvert(Type type)
+        {
+            return type == typeof(SyntaxTriviaList);
+        }
+
+        public override void WriteJson(JsonWriter writer, object value, JsonSerializer serializer)
+        {
+            writer.WriteStartArray();
+            foreach (var t in (SyntaxTriviaList)value)
+            {
+                if (t.IsKind(SyntaxKind.WhitespaceTrivia) || t.IsKind(SyntaxKind.EndOfLineTrivia))
+                {
+                    continue;
+                }
+                serializer.Serialize(writer, t);
+            }
+            writer.WriteEndArray();
+        }
+
+        public override object ReadJson(JsonReader reader, Type type, object existing, JsonSerializer serializer)
+        {
+            throw new NotSupportedException();
+        }
+    }
+
+    // ReusedNodes finds members of the incrementally reparsed tree that are the same as in the previous tree.
+    //
+    // A member is reused if its text wasn't changed, or touched by edits, and the old member of the same
+    // kind at the same position is equivalent to it. Members with diagnostics are never reused. Members
+    // with directives are only reused if they have the same trivia, since the text alone doesn't define
+    // the code disabled by the directives.
+    class ReusedNodes
+    {
+        // a change in positions of the new tree
+        struct Change
+        {
+            public int Start;
+            public int End;
+            public int Shift;
+        }
+
+        SyntaxNode _old;
+        List<Change> _changes;
+        Dictionary<TextSpan, SyntaxNode> _members;
+
+        // Reset forgets the previous tree. No members are reused until Set is called.
+        public void Reset()
+        {
+            _old = null;
+            _changes = null;
+            _members = null;
+        }
+
+        // Set prepares to find members of the tree parsed from the old one with given edits.
+        // Edits must be sorted by the position.
+        public void Set(SyntaxNode old, List<TextEdit> edits)
+        {
+            _old = old;
+            _changes = new List<Change>(edits.Count);
+            int shift = 0;
+            foreach (var e in edits)
+            {
+                int n = e.text == null ? 0 : e.text.Length;
+                int start = e.start + shift;
+                _changes.Add(new Change { Start = start, End = start + n, Shift = n - (e.end - e.start) });
+                shift += n - (e.end - e.start);
+            }
+        }
+
+        // Find returns a reference to the member of the previous tree, if the node can be reused.
+        public ReusedNode Find(MemberDeclarationSyntax node)
+        {
+            if (_old == null)
+            {
+                return null;
+            }
+            var span = node.FullSpan;
+            if (span.Length == 0 || node.ContainsDiagnostics)
+            {
+                return null;
+            }
+            int shift = 0;
+            foreach (var c in _changes)
+            {
+                if (span.End < c.Start)
+                {
+                    break;
+                }
+                else if (span.Start <= c.End)
+                {
+                    // changed or touched by the edit
+                    return null;
+                }
+                shift += c.Shift;
+            }
+            if (_members == null)
+            {
+                _members = new Dictionary<TextSpan, SyntaxNode>();
+                foreach (var m in _old.DescendantNodes(n => IsMembersContainer(n)).OfType<MemberDeclarationSyntax>())
+                {
+                    _members[m.FullSpan] = m;
+                }
+            }
+            SyntaxNode old;
+            var oldSpan = new TextSpan(span.Start - shift, span.Length);
+            if (!_members.TryGetValue(oldSpan, out old) || old.RawKind != node.RawKind)
+            {
+                return null;
+            }
+            if (old.ContainsDiagnostics || !old.IsEquivalentTo(node, false))
+            {
+                return null;
+            }
+            if ((old.ContainsDirectives || node.ContainsDirectives) && !SameTrivia(old, node))
+            {
+                return null;
+            }
+            return new ReusedNode { Start = oldSpan.Start, Length = oldSpan.Length, Shift = shift };
+        }
+
+        static bool IsMembersContainer(SyntaxNode n)
+        {
+            return n is CompilationUnitSyntax || n is NamespaceDeclarationSyntax || n is TypeDeclarationSyntax;
         }
 
-        static Object Parse(string source)
+        static bool SameTrivia(SyntaxNode a, SyntaxNode b)
         {
-            SyntaxTree tree = CSharpSyntaxTree.ParseText(source);
-            var cstree = (CSharpSyntaxTree)tree;
-            return cstree.GetRoot();
+            var ta = a.DescendantTrivia(descendIntoTrivia: true).Select(t => t.RawKind);
+            var tb = b.DescendantTrivia(descendIntoTrivia: true).Select(t => t.RawKind);
+            return ta.SequenceEqual(tb);
+        }
+    }
+
+    // MembersConverter writes a list of members, replacing members that can be reused with references.
+    class MembersConverter : JsonConverter
+    {
+        ReusedNodes _reused;
+
+        public MembersConverter(ReusedNodes reused)
+        {
+            _reused = reused;
+        }
+
+        public override bool CanConvert(Type type)
+        {
+            return type == typeof(SyntaxList<MemberDeclarationSyntax>);
+        }
+
+        public override void WriteJson(JsonWriter writer, object value, JsonSerializer serializer)
+        {
+            writer.WriteStartArray();
+            foreach (var m in (SyntaxList<MemberDeclarationSyntax>)value)
+            {
+                object r = _reused.Find(m);
+                serializer.Serialize(writer, r ?? m);
+            }
+            writer.WriteEndArray();
+        }
+
+        public override object ReadJson(JsonReader reader, Type type, object existing, JsonSerializer serializer)
+        {
+            throw new NotSupportedException();
         }
     }
 
     class ASTContractResolver : DefaultContractResolver
     {
+        // the lean schema, or null for the full schema
+        LeanSchema _lean;
+        MembersConverter _members;
+
+        public ASTContractResolver(LeanSchema lean, ReusedNodes reused)
+        {
+            _lean = lean;
+            _members = new MembersConverter(reused);
+        }
+
         protected override IList<JsonProperty> CreateProperties(Type type, MemberSerialization memberSerialization)
         {
             IList<JsonProperty> properties = base.CreateProperties(type, memberSerialization);
@@ -100,6 +673,23 @@ namespace native
                 }
             }).ToList();
 
+            foreach (var p in properties)
+            {
+                if (p.PropertyType == typeof(SyntaxList<MemberDeclarationSyntax>))
+                {
+                    p.Converter = _members;
+                }
+            }
+
+            var typeName = new TypeValueProvider(type, hasRawKind);
+            if (_lean != null)
+            {
+                foreach (var p in properties)
+                {
+                    SetLean(type, typeName, p);
+                }
+            }
+
             // add a virtual @type property
             properties.Add(new JsonProperty()
             {
@@ -107,11 +697,340 @@ namespace native
                 PropertyType = typeof(string),
                 Readable = true,
                 Writable = false,
-                ValueProvider = new TypeValueProvider(type, hasRawKind)
+                ValueProvider = typeName
             });
 
             return properties;
         }
+
+        // SetLean omits the property in the lean schema, see LeanSchema.
+        void SetLean(Type type, TypeValueProvider typeName, JsonProperty p)
+        {
+            string name = p.PropertyName;
+            IValueProvider value = p.ValueProvider;
+            switch (name)
+            {
+            case "IsMissing":
+            case "IsStructuredTrivia":
+            case "IsVar":
+            case "IsUnmanaged":
+            case "Arity":
+                p.ShouldSerialize = (target) => {
+                    object v = value.GetValue(target);
+                    if (!LeanSchema.IsDefault(v))
+                    {
+                        return true;
+                    }
+                    _lean.Add((string)typeName.GetValue(target), name, v);
+                    return false;
+                };
+                break;
+            case "Value":
+            case "ValueText":
+                if (type == typeof(SyntaxToken))
+                {
+                    p.ShouldSerialize = (target) => {
+                        var text = value.GetValue(target) as string;
+                        return text == null || text != ((SyntaxToken)target).Text;
+                    };
+                }
+                break;
+            case "LeadingTrivia":
+            case "TrailingTrivia":
+                if (type == typeof(SyntaxToken))
+                {
+                    p.Converter = new LeanTriviaConverter();
+                }
+                break;
+            }
+        }
+    }
+
+    // MessagePackWriter encodes values written by the JSON serializer with MessagePack.
+    //
+    // Sizes of maps and arrays are not known in advance, thus containers always use the 32 bit
+    // size header that is updated when the container ends.
+    class MessagePackWriter : JsonWriter
+    {
+        class Container
+        {
+            public long pos; // position of the container header
+            public uint size;
+            public bool isMap;
+        }
+
+        MemoryStream _buf = new MemoryStream();
+        Stack<Container> _stack = new Stack<Container>();
+
+        // ToFrame returns the encoded value prefixed with its length (32 bit, big-endian).
+        public byte[] ToFrame()
+        {
+            var data = _buf.ToArray();
+            var frame = new byte[4 + data.Length];
+            WriteUInt32(frame, 0, (uint)data.Length);
+            Buffer.BlockCopy(data, 0, frame, 4, data.Length);
+            return frame;
+        }
+
+        public override void Flush()
+        {
+        }
+
+        public override void WriteStartObject()
+        {
+            base.WriteStartObject();
+            StartContainer(0xdf, true);
+        }
+
+        public override void WriteStartArray()
+        {
+            base.WriteStartArray();
+            StartContainer(0xdd, false);
+        }
+
+        protected override void WriteEnd(JsonToken token)
+        {
+            var c = _stack.Pop();
+            var header = new byte[4];
+            WriteUInt32(header, 0, c.size);
+            long end = _buf.Position;
+            _buf.Position = c.pos + 1;
+            _buf.Write(header, 0, header.Length);
+            _buf.Position = end;
+        }
+
+        public override void WritePropertyName(string name)
+        {
+            base.WritePropertyName(name);
+            _stack.Peek().size++;
+            WriteString(name);
+        }
+
+        public override void WritePropertyName(string name, bool escape)
+        {
+            WritePropertyName(name);
+        }
+
+        public override void WriteNull()
+        {
+            base.WriteNull();
+            Item();
+            _buf.WriteByte(0xc0);
+        }
+
+        public override void WriteUndefined()
+        {
+            base.WriteUndefined();
+            Item();
+            _buf.WriteByte(0xc0);
+        }
+
+        public override void WriteValue(string value)
+        {
+            base.WriteValue(value);
+            Item();
+            if (value == null)
+            {
+                _buf.WriteByte(0xc0);
+                return;
+            }
+            WriteString(value);
+        }
+
+        public override void WriteValue(bool value)
+        {
+            base.WriteValue(value);
+            Item();
+            _buf.WriteByte(value ? (byte)0xc3 : (byte)0xc2);
+        }
+
+        public override void WriteValue(char value)
+        {
+            base.WriteValue(value);
+            Item();
+            WriteString(value.ToString());
+        }
+
+        public override void WriteValue(int value)
+        {
+            base.WriteValue(value);
+            Item();
+            WriteInt(value);
+        }
+
+        public override void WriteValue(uint value)
+        {
+            base.WriteValue(value);
+            Item();
+            WriteInt(value);
+        }
+
+        public override void WriteValue(long value)
+        {
+            base.WriteValue(value);
+            Item();
+            WriteInt(value);
+        }
+
+        public override void WriteValue(ulong value)
+        {
+            base.WriteValue(value);
+            Item();
+            if (value > long.MaxValue)
+            {
+                var b = new byte[9];
+                b[0] = 0xcf;
+                WriteUInt32(b, 1, (uint)(value >> 32));
+                WriteUInt32(b, 5, (uint)value);
+                _buf.Write(b, 0, b.Length);
+                return;
+            }
+            WriteInt((long)value);
+        }
+
+        public override void WriteValue(short value)
+        {
+            base.WriteValue(value);
+            Item();
+            WriteInt(value);
+        }
+
+        public override void WriteValue(ushort value)
+        {
+            base.WriteValue(value);
+            Item();
+            WriteInt(value);
+        }
+
+        public override void WriteValue(byte value)
+        {
+            base.WriteValue(value);
+            Item();
+            WriteInt(value);
+        }
+
+        public override void WriteValue(sbyte value)
+        {
+            base.WriteValue(value);
+            Item();
+            WriteInt(value);
+        }
+
+        public override void WriteValue(float value)
+        {
+            base.WriteValue(value);
+            Item();
+            WriteDouble(value);
+        }
+
+        public override void WriteValue(double value)
+        {
+            base.WriteValue(value);
+            Item();
+            WriteDouble(value);
+        }
+
+        public override void WriteValue(decimal value)
+        {
+            base.WriteValue(value);
+            Item();
+            WriteDouble((double)value);
+        }
+
+        public override void WriteValue(DateTime value)
+        {
+            base.WriteValue(value);
+            Item();
+            WriteString(value.ToString("o"));
+        }
+
+        public override void WriteValue(Guid value)
+        {
+            base.WriteValue(value);
+            Item();
+            WriteString(value.ToString());
+        }
+
+        // Item counts a new value in the current array. Map entries are counted by property names.
+        void Item()
+        {
+            if (_stack.Count != 0 && !_stack.Peek().isMap)
+            {
+                _stack.Peek().size++;
+            }
+        }
+
+        void StartContainer(byte code, bool isMap)
+        {
+            Item();
+            _stack.Push(new Container { pos = _buf.Position, isMap = isMap });
+            _buf.WriteByte(code);
+            _buf.Write(new byte[4], 0, 4);
+        }
+
+        void WriteString(string s)
+        {
+            var data = Encoding.UTF8.GetBytes(s);
+            if (data.Length < 32)
+            {
+                _buf.WriteByte((byte)(0xa0 | data.Length));
+            }
+            else
+            {
+                var b = new byte[5];
+                b[0] = 0xdb;
+                WriteUInt32(b, 1, (uint)data.Length);
+                _buf.Write(b, 0, b.Length);
+            }
+            _buf.Write(data, 0, data.Length);
+        }
+
+        void WriteInt(long v)
+        {
+            if (v >= 0 && v < 128)
+            {
+                // positive fixint
+                _buf.WriteByte((byte)v);
+            }
+            else if (v < 0 && v >= -32)
+            {
+                // negative fixint
+                _buf.WriteByte((byte)(0xe0 | (v + 32)));
+            }
+            else if (v >= int.MinValue && v <= int.MaxValue)
+            {
+                var b = new byte[5];
+                b[0] = 0xd2;
+                WriteUInt32(b, 1, (uint)(int)v);
+                _buf.Write(b, 0, b.Length);
+            }
+            else
+            {
+                var b = new byte[9];
+                b[0] = 0xd3;
+                WriteUInt32(b, 1, (uint)(v >> 32));
+                WriteUInt32(b, 5, (uint)v);
+                _buf.Write(b, 0, b.Length);
+            }
+        }
+
+        void WriteDouble(double v)
+        {
+            ulong bits = (ulong)BitConverter.DoubleToInt64Bits(v);
+            var b = new byte[9];
+            b[0] = 0xcb;
+            WriteUInt32(b, 1, (uint)(bits >> 32));
+            WriteUInt32(b, 5, (uint)bits);
+            _buf.Write(b, 0, b.Length);
+        }
+
+        static void WriteUInt32(byte[] b, int off, uint v)
+        {
+            b[off] = (byte)(v >> 24);
+            b[off + 1] = (byte)(v >> 16);
+            b[off + 2] = (byte)(v >> 8);
+            b[off + 3] = (byte)v;
+        }
     }
 
     class TypeValueProvider : IValueProvider {